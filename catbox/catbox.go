@@ -2,14 +2,14 @@ package catbox
 
 import (
 	"awake/pkg"
+	"awake/pkg/proxy"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -127,21 +127,27 @@ func (up *Uploader) UploadFile(file string, storageDuration time.Duration) (stri
 	return up.Upload(f, RandomName(6)+ext, "application/octet-stream", storageDuration)
 }
 
-func (up *Uploader) SetProxy(proxy string) error {
-	if proxy == "" {
-		up.client.Transport.(*http.Transport).Proxy = http.ProxyFromEnvironment
-		return nil
-	}
-	if !strings.Contains(proxy, "://") {
-		proxy = "http://" + proxy
-	}
-	u, err := url.Parse(proxy)
-	if err != nil {
-		return err
+// SetProxy routes uploads through a comma separated proxy chain,
+// empty string means using ALL_PROXY, HTTPS_PROXY, HTTP_PROXY and NO_PROXY from environment.
+func (up *Uploader) SetProxy(proxyURL string) error {
+	var (
+		dialer *proxy.Dialer
+		err    error
+	)
+	if proxyURL == "" {
+		dialer = proxy.FromEnvironment()
+	} else {
+		dialer, err = proxy.New(proxyURL)
+		if err != nil {
+			return err
+		}
 	}
-	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
-		return fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	dialer.Forward = &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
 	}
-	up.client.Transport.(*http.Transport).Proxy = http.ProxyURL(u)
+	transport := up.client.Transport.(*http.Transport)
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
 	return nil
 }
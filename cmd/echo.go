@@ -1,9 +1,11 @@
 package cmd
 
 import (
+	"awake/pkg"
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -30,11 +32,30 @@ var echoCmd = &cobra.Command{
 				}
 				logger.Infoln("udp echo server listen on", laddr.String())
 				buf := make([]byte, 65535)
+				// number of udping probes received from every client
+				probeCounts := make(map[string]uint32)
 				for {
 					n, raddr, err := conn.ReadFromUDP(buf)
 					if err != nil {
 						logger.Fatalln(err)
 					}
+					if probe, err := pkg.DecodeUDPProbe(buf[:n]); err == nil && !probe.Reply {
+						recv := time.Now()
+						if len(probeCounts) > 4096 {
+							clear(probeCounts)
+						}
+						probeCounts[raddr.String()]++
+						probe.Reply = true
+						probe.Received = probeCounts[raddr.String()]
+						probe.ServerRecv = recv.UnixNano()
+						probe.ServerSend = time.Now().UnixNano()
+						_, err = conn.WriteToUDP(probe.Encode(), raddr)
+						if err != nil {
+							logger.Fatalln(err)
+						}
+						logger.Infof("[udp] reflected probe seq=%d from %s", probe.Seq, raddr.String())
+						continue
+					}
 					var temp string
 					if n > 64 {
 						temp = string(buf[:64]) + "..."
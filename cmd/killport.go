@@ -3,47 +3,176 @@ package cmd
 import (
 	"awake/pkg"
 	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/mattn/go-isatty"
 	"github.com/spf13/cobra"
 )
 
 var killPortCmd = &cobra.Command{
 	Use:   "killport",
 	Short: "Kill processes occupying local ports",
-	Args:  cobra.MinimumNArgs(1),
+	Example: "  awake killport 8080 8081\n  awake killport 8080 --grace 5s -y\n  awake killport --list\n  awake killport --list 8080 -k inet\n" +
+		"  awake killport 3000-3010 --name '^node$'\n  awake killport 443 --established --listen-only=false --dry-run",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if list, _ := cmd.Flags().GetBool("list"); list {
+			return nil
+		}
+		return cobra.MinimumNArgs(1)(cmd, args)
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		kind, _ := cmd.Flags().GetString("kind")
-		switch kind {
-		case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "inet", "inet4", "inet6":
-		default:
-			logger.Fatalln("kind must be one of tcp, tcp4, tcp6, udp, udp4, udp6, inet, inet4, inet6")
-		}
-		ports := make([]int, 0)
-		portMap := make(map[int]struct{})
-		for i := range len(args) {
-			p, err := strconv.Atoi(args[i])
-			if err == nil && (p < 0 || p > 65535) {
-				err = errors.New("port must be between 0 and 65535")
+		list, _ := cmd.Flags().GetBool("list")
+		signal, _ := cmd.Flags().GetString("signal")
+		grace, _ := cmd.Flags().GetDuration("grace")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		yes, _ := cmd.Flags().GetBool("yes")
+		listenOnly, _ := cmd.Flags().GetBool("listen-only")
+		established, _ := cmd.Flags().GetBool("established")
+		pidFilter, _ := cmd.Flags().GetString("pid-filter")
+		nameFilter, _ := cmd.Flags().GetString("name")
+		filter, err := pkg.NewPortFilter(kind, args)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		filter.Listen, filter.Established = listenOnly, established
+		// --established alone replaces the default, both flags given explicitly match both
+		if established && !cmd.Flags().Changed("listen-only") {
+			filter.Listen = false
+		}
+		// listing shows every state unless asked
+		if list && !cmd.Flags().Changed("listen-only") && !established {
+			filter.Listen = false
+		}
+		if pidFilter != "" {
+			if filter.PID, err = regexp.Compile(pidFilter); err != nil {
+				logger.Fatalf("invalid pid filter %s: %v", pidFilter, err)
+			}
+		}
+		if nameFilter != "" {
+			if filter.Name, err = regexp.Compile(nameFilter); err != nil {
+				logger.Fatalf("invalid name filter %s: %v", nameFilter, err)
 			}
+		}
+		if list {
+			processes, err := pkg.ListPortProcesses(filter)
 			if err != nil {
-				logger.Fatalf("%s is not a valid port: %v", args[i], err)
+				logger.Fatalf("list kind %s error: %v", kind, err)
 			}
-			if _, ok := portMap[p]; !ok {
-				portMap[p] = struct{}{}
-				ports = append(ports, p)
+			printPortProcesses(processes)
+			return
+		}
+		if grace > 0 && !pkg.SignalsSupported {
+			logger.Fatalf("--grace is not supported on %s, processes can only be killed", runtime.GOOS)
+		}
+		var sig os.Signal = os.Kill
+		if grace > 0 {
+			sig = syscall.SIGTERM
+		}
+		if signal != "" {
+			if sig, err = pkg.ParseSignal(signal); err != nil {
+				logger.Fatalln(err)
 			}
 		}
-		for _, p := range ports {
-			err := pkg.KillPortProcess(p, kind)
-			if err != nil {
-				logger.Fatalf("kill kind %s port %d error: %v", kind, p, err)
+		targets, err := pkg.FindKillTargets(filter)
+		if err != nil {
+			logger.Fatalf("find kind %s error: %v", kind, err)
+		}
+		if len(targets) == 0 {
+			logger.Warnln("No process found")
+			return
+		}
+		printKillTargets(targets)
+		if dryRun {
+			logger.Infof("Dry run, would send SIG%s to %d processes", pkg.SignalName(sig), len(targets))
+			return
+		}
+		// only ask when someone can answer, eg. not in scripts
+		if !yes && (isatty.IsTerminal(os.Stdin.Fd()) || isatty.IsCygwinTerminal(os.Stdin.Fd())) {
+			var answer string
+			fmt.Printf("Send SIG%s to %d processes? (y/n): ", pkg.SignalName(sig), len(targets))
+			fmt.Scanln(&answer)
+			if strings.Trim(strings.ToLower(answer), "\r\n\t ") != "y" {
+				logger.Warnln("Stop killing")
+				return
+			}
+		}
+		failed := false
+		for _, r := range pkg.KillProcesses(targets, pkg.KillOptions{Signal: sig, Grace: grace, Kind: kind}) {
+			switch {
+			case errors.Is(r.Err, os.ErrProcessDone):
+				logger.Infof("%d %s already exited", r.PID, r.Name)
+			case r.Err != nil:
+				failed = true
+				logger.Errorf("%d %s SIG%s error: %v", r.PID, r.Name, r.Signal, r.Err)
+			case r.Escalated:
+				logger.Warnf("%d %s still held ports after %v, sent SIGKILL", r.PID, r.Name, grace)
+			default:
+				logger.Infof("%d %s sent SIG%s", r.PID, r.Name, r.Signal)
 			}
 		}
+		if failed {
+			os.Exit(1)
+		}
 	},
 }
 
+func printPortProcesses(processes []*pkg.PortProcess) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PID\tNAME\tUSER\tPROTO\tSTATE\tLOCAL\tREMOTE\tSTARTED\tCOMMAND")
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	for _, p := range processes {
+		pid, started := "-", "-"
+		if p.PID > 0 {
+			pid = strconv.Itoa(int(p.PID))
+		}
+		// keep a row per line, arguments may contain newlines
+		command := strings.Join(strings.Fields(p.Cmdline), " ")
+		if !p.Started.IsZero() {
+			started = p.Started.Format(time.DateTime)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", pid, orDash(p.Name), orDash(p.User), p.Proto,
+			orDash(p.State), p.Laddr, orDash(p.Raddr), started, orDash(command))
+	}
+	w.Flush()
+}
+
+func printKillTargets(targets []*pkg.KillTarget) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PID\tNAME\tPORTS\tCOMMAND")
+	for _, t := range targets {
+		ports := make([]string, len(t.Ports))
+		for i, p := range t.Ports {
+			ports[i] = strconv.Itoa(p)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", t.PID, t.Name, strings.Join(ports, ","), strings.Join(strings.Fields(t.Cmdline), " "))
+	}
+	w.Flush()
+}
+
 func init() {
 	killPortCmd.Flags().StringP("kind", "k", "tcp", "kind must be one of tcp, tcp4, tcp6, udp, udp4, udp6, inet, inet4, inet6")
+	killPortCmd.Flags().BoolP("list", "l", false, "list processes on the ports instead of killing them, all ports if none given")
+	killPortCmd.Flags().Bool("listen-only", true, "match listening sockets, outbound connections from the ports are left alone")
+	killPortCmd.Flags().Bool("established", false, "match established connections instead, or as well with --listen-only")
+	killPortCmd.Flags().String("pid-filter", "", "regexp matched against the pid")
+	killPortCmd.Flags().String("name", "", "regexp matched against the process name")
+	killPortCmd.Flags().StringP("signal", "s", "", "signal to send, one of TERM, INT, HUP, KILL, default KILL, or TERM with --grace, only KILL on windows")
+	killPortCmd.Flags().Duration("grace", 0, "send SIGKILL if the ports are still held after the duration, eg. 5s, not supported on windows")
+	killPortCmd.Flags().Bool("dry-run", false, "show the processes without killing them")
+	killPortCmd.Flags().BoolP("yes", "y", false, "don't ask for confirmation")
 	rootCmd.AddCommand(killPortCmd)
 }
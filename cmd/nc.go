@@ -1,57 +1,271 @@
 package cmd
 
 import (
+	"awake/pkg"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
 var ncCmd = &cobra.Command{
-	Use:     "nc",
-	Short:   "Netcat, only for tcp",
-	Example: "  awake nc 1.1.1.1 80 -p socks5://127.0.0.1:1080",
-	Args:    cobra.ExactArgs(2),
+	Use:   "nc",
+	Short: "Netcat for tcp and unix sockets",
+	Example: "  awake nc 1.1.1.1 80 -p socks5://127.0.0.1:1080\n  awake nc 127.0.0.1 6379 --hexdump --send-hex 50494e470d0a\n" +
+		"  awake nc unix:/var/run/docker.sock\n  awake nc -l unix:/tmp/app.sock --relay 127.0.0.1:8080",
+	Args: cobra.RangeArgs(1, 2),
 	Run: func(cmd *cobra.Command, args []string) {
-		targetAddr := net.JoinHostPort(args[0], args[1])
 		proxy, _ := cmd.Flags().GetString("proxy")
-		var (
-			conn net.Conn
-			err  error
-		)
-		if proxy == "" {
-			conn, err = net.Dial("tcp", targetAddr)
-		} else {
-			conn, err = dialTCPWithProxy(proxy, targetAddr)
+		envProxy, _ := cmd.Flags().GetBool("env-proxy")
+		listen, _ := cmd.Flags().GetBool("listen")
+		relay, _ := cmd.Flags().GetString("relay")
+		hexdump, _ := cmd.Flags().GetBool("hexdump")
+		logFile, _ := cmd.Flags().GetString("log-file")
+		sendHex, _ := cmd.Flags().GetString("send-hex")
+		network, addr, err := parseNcTarget(args)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		if relay != "" && !listen {
+			logger.Fatalln("--relay is only available in listen mode")
+		}
+		var payload []byte
+		if sendHex != "" {
+			b, err := hex.DecodeString(strings.Join(strings.Fields(sendHex), ""))
+			if err != nil {
+				logger.Fatalln("invalid hex payload:", err)
+			}
+			payload = b
+		}
+		var dumpWriters []io.Writer
+		if hexdump {
+			dumpWriters = append(dumpWriters, os.Stderr)
+		}
+		if logFile != "" {
+			f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				logger.Fatalln(err)
+			}
+			defer f.Close()
+			dumpWriters = append(dumpWriters, f)
+		}
+		wrap := func(conn net.Conn) net.Conn {
+			if len(dumpWriters) > 0 {
+				return &dumpConn{Conn: conn, w: io.MultiWriter(dumpWriters...)}
+			}
+			return conn
+		}
+		stdio := struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout}
+
+		if !listen {
+			conn, err := dialNcTarget(network, addr, proxy, envProxy)
+			if err != nil {
+				logger.Fatalln(err)
+			}
+			conn = wrap(conn)
+			if len(payload) > 0 {
+				if _, err := conn.Write(payload); err != nil {
+					conn.Close()
+					logger.Fatalln(err)
+				}
+			}
+			if err := bridge(conn, stdio); err != nil {
+				logger.Fatalln(err)
+			}
+			return
+		}
+
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, os.Interrupt)
+		if network == "unixgram" {
+			if relay != "" {
+				logger.Fatalln("--relay is not supported for unixgram listener")
+			}
+			conn, err := net.ListenUnixgram(network, &net.UnixAddr{Name: addr, Net: network})
+			if err != nil {
+				logger.Fatalln(err)
+			}
+			logger.Infoln("listen on", network+":"+addr)
+			go func() {
+				<-quit
+				conn.Close()
+			}()
+			_, err = io.Copy(os.Stdout, wrap(conn))
+			// unlike the unix listener, closing a unixgram conn leaves the socket file behind
+			conn.Close()
+			os.Remove(addr)
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.Fatalln(err)
+			}
+			return
+		}
+		var relayNetwork, relayAddr string
+		if relay != "" {
+			relayNetwork, relayAddr, err = parseNcTarget([]string{relay})
+			if err != nil {
+				logger.Fatalln(err)
+			}
 		}
+		ln, err := net.Listen(network, addr)
 		if err != nil {
 			logger.Fatalln(err)
 		}
-		var once sync.Once
-		ch := make(chan error, 1)
+		logger.Infoln("listen on", network+":"+ln.Addr().String())
 		go func() {
-			_, err = io.Copy(conn, os.Stdin)
-			once.Do(func() {
-				ch <- err
-			})
+			<-quit
+			// closing the listener also removes the unix socket file
+			ln.Close()
 		}()
-		go func() {
-			_, err = io.Copy(os.Stdout, conn)
-			once.Do(func() {
-				ch <- err
-			})
-		}()
-		err = <-ch
-		conn.Close()
-		if err != nil {
-			logger.Fatalln(err)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				logger.Fatalln(err)
+			}
+			logger.Infoln("accepted connection from", conn.RemoteAddr())
+			conn = wrap(conn)
+			if relay == "" {
+				// stdio can only serve one peer
+				ln.Close()
+				if len(payload) > 0 {
+					if _, err := conn.Write(payload); err != nil {
+						conn.Close()
+						logger.Fatalln(err)
+					}
+				}
+				if err := bridge(conn, stdio); err != nil {
+					logger.Fatalln(err)
+				}
+				return
+			}
+			go func() {
+				target, err := dialNcTarget(relayNetwork, relayAddr, proxy, envProxy)
+				if err != nil {
+					logger.Errorln(err)
+					conn.Close()
+					return
+				}
+				if err := bridge(conn, target); err != nil {
+					logger.Warnln(err)
+				}
+				target.Close()
+				logger.Infoln("connection from", conn.RemoteAddr(), "closed")
+			}()
 		}
 	},
 }
 
+// parseNcTarget accepts "host port", "host:port", "port", "unix:/path" and "unixgram:/path"
+func parseNcTarget(args []string) (network string, addr string, err error) {
+	if len(args) == 2 {
+		return "tcp", net.JoinHostPort(args[0], args[1]), nil
+	}
+	s := args[0]
+	for _, v := range []string{"unix", "unixgram"} {
+		if p, ok := strings.CutPrefix(s, v+":"); ok {
+			if p == "" {
+				return "", "", fmt.Errorf("empty socket path: %s", s)
+			}
+			return v, p, nil
+		}
+	}
+	if _, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return "tcp", ":" + s, nil
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return "", "", err
+	}
+	return "tcp", s, nil
+}
+
+// dialNcTarget dials directly unless proxy is set or envProxy asks for the proxy from environment
+func dialNcTarget(network, addr, proxy string, envProxy bool) (net.Conn, error) {
+	if network == "tcp" && (proxy != "" || envProxy) {
+		return dialTCPWithProxy(context.Background(), proxy, addr, 0)
+	}
+	if proxy != "" {
+		return nil, fmt.Errorf("proxy is not supported for %s", network)
+	}
+	return net.Dial(network, addr)
+}
+
+// bridge copies data between conn and rw until either side is done, then closes conn
+func bridge(conn net.Conn, rw io.ReadWriter) error {
+	var once sync.Once
+	ch := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn, rw)
+		once.Do(func() {
+			ch <- err
+		})
+	}()
+	go func() {
+		_, err := io.Copy(rw, conn)
+		once.Do(func() {
+			ch <- err
+		})
+	}()
+	err := <-ch
+	conn.Close()
+	return err
+}
+
+// dumpConn writes a timestamped hexdump of all traffic to w, ">" for sent and "<" for received
+type dumpConn struct {
+	net.Conn
+	w io.Writer
+
+	mu       sync.Mutex
+	sent     int64
+	received int64
+}
+
+func (c *dumpConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.dump("<", b[:n], &c.received)
+	}
+	return n, err
+}
+
+func (c *dumpConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.dump(">", b[:n], &c.sent)
+	}
+	return n, err
+}
+
+func (c *dumpConn) dump(direction string, b []byte, offset *int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.w, "%s %s %d bytes (offset %d)\n%s",
+		time.Now().Format("2006-01-02T15:04:05.000Z0700"), direction, len(b), *offset, pkg.HexDump(b, *offset))
+	*offset += int64(len(b))
+}
+
 func init() {
-	ncCmd.Flags().StringP("proxy", "p", "", "proxy url")
+	ncCmd.Flags().StringP("proxy", "p", "", "comma separated proxy chain, eg. socks5h://127.0.0.1:1080,http://10.0.0.1:8080")
+	ncCmd.Flags().Bool("env-proxy", false, "without --proxy, connect through ALL_PROXY, HTTPS_PROXY or HTTP_PROXY, honouring NO_PROXY")
+	ncCmd.Flags().BoolP("listen", "l", false, "listen mode, accept one connection and bridge it to stdio")
+	ncCmd.Flags().String("relay", "", "in listen mode, relay every accepted connection to this target, eg. 127.0.0.1:80, unix:/tmp/app.sock")
+	ncCmd.Flags().Bool("hexdump", false, "print hexdump of sent(>) and received(<) data to stderr")
+	ncCmd.Flags().String("log-file", "", "append hexdump of sent and received data to file")
+	ncCmd.Flags().String("send-hex", "", "send hexadecimal payload after connecting, whitespace is ignored")
 	rootCmd.AddCommand(ncCmd)
 }
@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pingStats accumulates the results of probes, the rtt of every successful probe is kept
+type pingStats struct {
+	total   int64
+	success int64
+	min     time.Duration
+	max     time.Duration
+	sum     time.Duration
+	samples []time.Duration
+}
+
+func (s *pingStats) add(t time.Duration, ok bool) {
+	s.total += 1
+	if !ok {
+		return
+	}
+	s.success += 1
+	s.sum += t
+	s.samples = append(s.samples, t)
+	if s.min == 0 || t < s.min {
+		s.min = t
+	}
+	if t > s.max {
+		s.max = t
+	}
+}
+
+func (s *pingStats) avg() time.Duration {
+	if s.success == 0 {
+		return 0
+	}
+	return s.sum / time.Duration(s.success)
+}
+
+func (s *pingStats) loss() float64 {
+	if s.total == 0 {
+		return 0
+	}
+	return float64(s.total-s.success) / float64(s.total) * 100
+}
+
+// percentile uses the nearest-rank method, p is in (0, 100]
+func (s *pingStats) percentile(p float64) time.Duration {
+	if len(s.samples) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(s.samples)
+	slices.Sort(sorted)
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[min(max(rank, 1), len(sorted))-1]
+}
+
+// stdDev is the population standard deviation
+func (s *pingStats) stdDev() time.Duration {
+	if len(s.samples) == 0 {
+		return 0
+	}
+	avg := float64(s.avg())
+	var v float64
+	for _, t := range s.samples {
+		v += (float64(t) - avg) * (float64(t) - avg)
+	}
+	return time.Duration(math.Sqrt(v / float64(len(s.samples))))
+}
+
+// jitter is the mean absolute difference between consecutive rtts
+func (s *pingStats) jitter() time.Duration {
+	if len(s.samples) < 2 {
+		return 0
+	}
+	var sum time.Duration
+	for i := 1; i < len(s.samples); i++ {
+		d := s.samples[i] - s.samples[i-1]
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return sum / time.Duration(len(s.samples)-1)
+}
+
+func (s *pingStats) String() string {
+	return fmt.Sprintf("Total = %d, Success = %d, Fail = %d, Pass Percentage = %.1f%%\nMin = %v, Max = %v, Avg = %v\n"+
+		"P50 = %v, P90 = %v, P99 = %v, StdDev = %v, Jitter = %v",
+		s.total, s.success, s.total-s.success, float64(s.success)/float64(s.total)*100, s.min, s.max, s.avg(),
+		s.percentile(50), s.percentile(90), s.percentile(99), s.stdDev(), s.jitter())
+}
+
+// pingRecordWriter writes one record per probe and a summary per target as json lines or csv
+type pingRecordWriter struct {
+	mu   sync.Mutex
+	json *json.Encoder
+	csv  *csv.Writer
+}
+
+func newPingRecordWriter(w io.Writer, format string) (*pingRecordWriter, error) {
+	rw := &pingRecordWriter{}
+	switch format {
+	case "json":
+		rw.json = json.NewEncoder(w)
+	case "csv":
+		rw.csv = csv.NewWriter(w)
+		rw.csv.Write([]string{"type", "target", "address", "seq", "timestamp", "success", "rtt_ms", "error",
+			"dns_ms", "connect_ms", "tls_ms", "ttfb_ms", "status",
+			"total", "received", "loss_pct", "min_ms", "avg_ms", "max_ms", "p50_ms", "p90_ms", "p99_ms", "stddev_ms", "jitter_ms"})
+		rw.csv.Flush()
+	default:
+		return nil, fmt.Errorf("unsupported output format: %s, must be json or csv", format)
+	}
+	return rw, nil
+}
+
+type pingProbeRecord struct {
+	Type      string    `json:"type"`
+	Target    string    `json:"target"`
+	Address   string    `json:"address"`
+	Seq       int       `json:"seq"`
+	Timestamp time.Time `json:"timestamp"`
+	Success   bool      `json:"success"`
+	RTT       float64   `json:"rtt_ms"`
+	Error     string    `json:"error,omitempty"`
+	// phases of tcping, zero means not measured
+	DNS     float64 `json:"dns_ms,omitempty"`
+	Connect float64 `json:"connect_ms,omitempty"`
+	TLS     float64 `json:"tls_ms,omitempty"`
+	TTFB    float64 `json:"ttfb_ms,omitempty"`
+	Status  int     `json:"status,omitempty"`
+}
+
+type pingSummaryRecord struct {
+	Type     string  `json:"type"`
+	Target   string  `json:"target"`
+	Address  string  `json:"address"`
+	Total    int64   `json:"total"`
+	Received int64   `json:"received"`
+	Loss     float64 `json:"loss_pct"`
+	Min      float64 `json:"min_ms"`
+	Avg      float64 `json:"avg_ms"`
+	Max      float64 `json:"max_ms"`
+	P50      float64 `json:"p50_ms"`
+	P90      float64 `json:"p90_ms"`
+	P99      float64 `json:"p99_ms"`
+	StdDev   float64 `json:"stddev_ms"`
+	Jitter   float64 `json:"jitter_ms"`
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func formatMs(v float64) string {
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
+
+func newPingProbeRecord(target, addr string, seq int, at time.Time, rtt time.Duration, err error) *pingProbeRecord {
+	r := &pingProbeRecord{
+		Type:      "probe",
+		Target:    target,
+		Address:   addr,
+		Seq:       seq,
+		Timestamp: at,
+		Success:   err == nil,
+	}
+	if err == nil {
+		r.RTT = durationMs(rtt)
+	} else {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+func (rw *pingRecordWriter) probe(r *pingProbeRecord) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.json != nil {
+		rw.json.Encode(r)
+		return
+	}
+	optional := func(v float64) string {
+		if v == 0 {
+			return ""
+		}
+		return formatMs(v)
+	}
+	status := ""
+	if r.Status != 0 {
+		status = strconv.Itoa(r.Status)
+	}
+	rtt := ""
+	if r.Success {
+		rtt = formatMs(r.RTT)
+	}
+	rw.csv.Write([]string{r.Type, r.Target, r.Address, strconv.Itoa(r.Seq), r.Timestamp.Format(time.RFC3339Nano),
+		strconv.FormatBool(r.Success), rtt, r.Error,
+		optional(r.DNS), optional(r.Connect), optional(r.TLS), optional(r.TTFB), status,
+		"", "", "", "", "", "", "", "", "", "", ""})
+	rw.csv.Flush()
+}
+
+func (rw *pingRecordWriter) summary(target, addr string, s *pingStats) {
+	r := &pingSummaryRecord{
+		Type:     "summary",
+		Target:   target,
+		Address:  addr,
+		Total:    s.total,
+		Received: s.success,
+		Loss:     s.loss(),
+		Min:      durationMs(s.min),
+		Avg:      durationMs(s.avg()),
+		Max:      durationMs(s.max),
+		P50:      durationMs(s.percentile(50)),
+		P90:      durationMs(s.percentile(90)),
+		P99:      durationMs(s.percentile(99)),
+		StdDev:   durationMs(s.stdDev()),
+		Jitter:   durationMs(s.jitter()),
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.json != nil {
+		rw.json.Encode(r)
+		return
+	}
+	rw.csv.Write([]string{r.Type, r.Target, r.Address, "", "", "", "", "", "", "", "", "", "",
+		strconv.FormatInt(r.Total, 10), strconv.FormatInt(r.Received, 10), strconv.FormatFloat(r.Loss, 'f', 1, 64),
+		formatMs(r.Min), formatMs(r.Avg), formatMs(r.Max), formatMs(r.P50), formatMs(r.P90), formatMs(r.P99),
+		formatMs(r.StdDev), formatMs(r.Jitter)})
+	rw.csv.Flush()
+}
@@ -2,20 +2,152 @@ package cmd
 
 import (
 	"awake/pkg"
+	"awake/pkg/proxy"
 	"errors"
 	"fmt"
 	"net"
 	"net/url"
+	"os"
 	"sort"
-	"strconv"
-	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/spf13/cobra"
 )
 
+// scanHostState is the progress of a host, results are nil before the host is started and after it's printed
+type scanHostState struct {
+	results   []scanResult
+	remaining int
+}
+
+// scanHost is an address to scan, name is the target it was expanded or resolved from,
+// ip is the name itself if the proxy resolves it
+type scanHost struct {
+	name string
+	ip   string
+	rtt  rttEstimator
+}
+
+func (h *scanHost) String() string {
+	if h.name == h.ip {
+		return h.ip
+	}
+	return fmt.Sprintf("%s (%s)", h.name, h.ip)
+}
+
+// resolveScanTargets expands cidr and dash ranges and resolves names, every resolved address of a name is scanned.
+// If remote is true, names are kept for the proxy to resolve, so that they never leak to the local resolver.
+func resolveScanTargets(targets []string, remote bool) ([]*scanHost, error) {
+	var hosts []*scanHost
+	seen := make(map[string]struct{})
+	add := func(name, ip string) {
+		if _, ok := seen[ip]; ok {
+			return
+		}
+		seen[ip] = struct{}{}
+		hosts = append(hosts, &scanHost{name: name, ip: ip})
+	}
+	for _, target := range targets {
+		if u, err := url.Parse(target); err == nil {
+			if v := u.Hostname(); v != "" {
+				target = v
+			}
+		}
+		ips, ok, err := pkg.ExpandHosts(target)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			for _, ip := range ips {
+				add(ip, ip)
+			}
+			continue
+		}
+		if !pkg.IsDomainName(target) && !pkg.IsIP(target) {
+			return nil, fmt.Errorf("invalid host: %s", target)
+		}
+		if remote {
+			add(target, target)
+			continue
+		}
+		addrs, err := net.LookupHost(target)
+		if err != nil {
+			if len(targets) == 1 {
+				return nil, err
+			}
+			// one bad name should not abort a sweep
+			logger.Warnln(err)
+			continue
+		}
+		for _, ip := range addrs {
+			add(target, ip)
+		}
+	}
+	return hosts, nil
+}
+
+// parseScanPorts merges port list, port range and top ports, invalid ports are dropped
+func parseScanPorts(ports []int, portRange string, topPorts []int) ([]int, error) {
+	uniqueSet := make(map[int]struct{})
+	for _, p := range ports {
+		uniqueSet[p] = struct{}{}
+	}
+	for _, p := range topPorts {
+		uniqueSet[p] = struct{}{}
+	}
+	if portRange != "" {
+		v, err := pkg.ParsePortRanges(portRange)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range v {
+			uniqueSet[p] = struct{}{}
+		}
+	}
+	var result []int
+	for p := range uniqueSet {
+		if p >= 0 && p <= 65535 {
+			result = append(result, p)
+		}
+	}
+	sort.Ints(result)
+	if len(result) == 0 {
+		return nil, errors.New("no port to scan")
+	}
+	return result, nil
+}
+
+var scanDiffCmd = &cobra.Command{
+	Use:   "diff old.json new.json",
+	Short: "Report ports that opened or closed between two scans",
+	Long: "Report ports that opened or closed between two scans saved with `awake scan -o json`,\n" +
+		"exit status is 1 if there is any difference, like diff(1).",
+	Example: "  awake scan 10.0.0.0/24 --top-ports 100 -o json > new.json && awake scan diff old.json new.json",
+	Args:    cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		old, err := readScanReport(args[0])
+		if err != nil {
+			return err
+		}
+		new, err := readScanReport(args[1])
+		if err != nil {
+			return err
+		}
+		lines, err := diffScanReports(old, new)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		if len(lines) > 0 {
+			os.Exit(1)
+		}
+		return nil
+	},
+}
+
 func init() {
 	var (
 		timeout     time.Duration
@@ -23,91 +155,370 @@ func init() {
 		portRange   string
 		concurrency int
 		verbose     bool
+		inputList   string
+		banner      bool
+		bannerWait  time.Duration
+		udp         bool
+		rate        float64
+		retries     int
+		adaptive    bool
+		topPorts    int
+		output      string
+		checkpoint  string
+		resume      bool
+		proxyURL    string
 	)
 
 	portScanCmd := &cobra.Command{
-		Use:     "scan",
-		Short:   "TCP port scanning",
-		Example: "  awake scan 1.1.1.1 -p 80\n  awake scan 1.1.1.1 -r 80-443",
-		Args:    cobra.ExactArgs(1),
+		Use:   "scan",
+		Short: "TCP and UDP port scanning",
+		Long: "TCP and UDP port scanning, targets can be host names, ips, cidr (10.0.0.0/24) or dash ranges (10.0.0.1-50, 10.0.0.1-10.0.1.20),\n" +
+			"every resolved address of a host name is scanned.\n" +
+			"TCP ports are open, closed (refused) or filtered (no answer). UDP ports are open if any response arrives,\n" +
+			"closed if ICMP port unreachable is reported, otherwise open|filtered. UDP probes are limited to 100 packets per second by default.\n" +
+			"Timeouts adapt to the RTTs of open ports, starting from and never exceeding --timeout, and double on each retry.\n" +
+			"Through --proxy, ports are classified by the proxy replies, failures that tell nothing about the port are proxy-error.",
+		Example: "  awake scan 1.1.1.1 -p 80\n  awake scan 1.1.1.1 -r 80-443 --banner\n" +
+			"  awake scan 10.0.0.0/24 10.0.1.1-50 example.com -p 22,80,443\n  awake scan -iL hosts.txt -p 22\n" +
+			"  awake scan 10.0.0.1 --udp -p 53,123,161\n  awake scan 10.0.0.0/24 --top-ports 100 --rate 200 --retries 1\n" +
+			"  awake scan 10.0.0.0/16 -r 1-65535 --checkpoint scan.ckpt --resume\n" +
+			"  awake scan 192.168.0.0/24 --top-ports 20 --proxy socks5h://jumphost:1080",
+		Args: cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if u, err := url.Parse(args[0]); err == nil {
-				if v := u.Hostname(); v != "" {
-					args[0] = v
+			targets := args
+			if inputList != "" {
+				v, err := readTargetsFile(inputList)
+				if err != nil {
+					return err
+				}
+				targets = append(targets, v...)
+			}
+			if len(targets) == 0 {
+				return errors.New("no target, specify targets as arguments or use -iL")
+			}
+			if udp && proxyURL != "" {
+				return errors.New("--proxy is for tcp only")
+			}
+			var remote bool
+			if proxyURL != "" {
+				dialer, err := proxy.New(proxyURL)
+				if err != nil {
+					return err
 				}
+				remote = dialer.ResolvesRemotely()
+			}
+			hosts, err := resolveScanTargets(targets, remote)
+			if err != nil {
+				return err
+			}
+			if len(hosts) == 0 {
+				return errors.New("no host to scan")
 			}
-			if !pkg.IsDomainName(args[0]) && !pkg.IsIP(args[0]) {
-				return fmt.Errorf("invalid host: %s", args[0])
+			top := pkg.TopPorts(topPorts, udp)
+			if len(top) < topPorts {
+				logger.Warnf("--top-ports %d is larger than the list of common ports, scanning all %d of them", topPorts, len(top))
 			}
-			addrs, err := net.LookupHost(args[0])
+			ports, err := parseScanPorts(ports, portRange, top)
 			if err != nil {
 				return err
 			}
-			ip := addrs[0]
-			uniqueSet := make(map[int]struct{})
-			for _, p := range ports {
-				uniqueSet[p] = struct{}{}
+			total := len(hosts) * len(ports)
+			if concurrency > total {
+				concurrency = total
 			}
-			if portRange != "" {
-				ss := strings.Split(portRange, "-")
-				if len(ss) != 2 {
-					return errors.New("can't get port range")
+			if udp && banner {
+				return errors.New("--banner is for tcp only, udp responses are always shown")
+			}
+			switch output {
+			case "", "json", "csv", "grepable":
+			default:
+				return fmt.Errorf("unsupported output format: %s, must be json, csv or grepable", output)
+			}
+			if retries < 0 {
+				return errors.New("retries must not be negative")
+			}
+			var restored *scanCheckpoint
+			if resume && checkpoint == "" {
+				return errors.New("--resume requires --checkpoint")
+			} else if resume {
+				restored, err = loadScanCheckpoint(checkpoint)
+				if errors.Is(err, os.ErrNotExist) {
+					logger.Warnln("checkpoint not found, start from scratch:", checkpoint)
+				} else if err != nil {
+					return err
+				} else if restored.Protocol == "udp" != udp {
+					return fmt.Errorf("checkpoint is a %s scan, --udp must match", restored.Protocol)
 				}
-				start, _ := strconv.Atoi(ss[0])
-				end, _ := strconv.Atoi(ss[1])
-				for i := start; i <= end; i++ {
-					uniqueSet[int(i)] = struct{}{}
+			} else if checkpoint != "" {
+				if _, err := os.Stat(checkpoint); err == nil {
+					return fmt.Errorf("checkpoint %s exists, use --resume to continue or remove it", checkpoint)
+				}
+			}
+			s := &scanner{timeout: timeout, adaptive: adaptive, retries: retries, banner: banner, bannerWait: bannerWait, proxy: proxyURL}
+			if proxyURL != "" {
+				if err := checkScanProxy(proxyURL, timeout); err != nil {
+					return err
 				}
 			}
-			ports = ports[:0]
-			for p := range uniqueSet {
-				if p >= 0 && p <= 65535 {
-					ports = append(ports, p)
+			probe := s.probeTCP
+			if udp {
+				probe = s.probeUDP
+				if !cmd.Flags().Changed("rate") {
+					rate = udpScanRate
 				}
 			}
-			sort.Ints(ports)
-			if len(ports) == 0 {
-				return errors.New("no port to scan")
+			if rate > 0 {
+				// a tenth of a second worth of burst
+				s.limiter = newTokenBucket(rate, max(1, int(rate/10)))
 			}
-			if concurrency > len(ports) {
-				concurrency = len(ports)
+			// machine-readable output replaces the table and is written sorted when all done
+			human := output == ""
+			if human && len(hosts) == 1 {
+				fmt.Printf("Scanning %s with %d ports at %s\n", hosts[0], len(ports), time.Now().Format(time.RFC3339))
+			} else if human {
+				fmt.Printf("Scanning %d hosts with %d ports at %s\n", len(hosts), len(ports), time.Now().Format(time.RFC3339))
+			}
+
+			// hosts are started in order and printed in order as soon as all their ports are done,
+			// then only their reports and checkpoint entries are kept, so the results of all ports
+			// are held only for the few hosts from next to started
+			var (
+				mu       sync.Mutex
+				states   = make([]scanHostState, len(hosts))
+				next     int
+				started  int
+				counts   = make(map[string]int)
+				reports  []*scanHostReport
+				finished []*scanCheckpointHost
+			)
+			var restoredHosts map[string]*scanCheckpointHost
+			if restored != nil {
+				restoredHosts = restored.index()
+				pending := total
+				for _, host := range hosts {
+					if h, ok := restoredHosts[host.ip]; ok {
+						n, err := h.apply(ports, nil)
+						if err != nil {
+							return err
+						}
+						pending -= n
+					}
+				}
+				if human {
+					fmt.Printf("Resuming from %s, %d of %d done\n", checkpoint, total-pending, total)
+				}
 			}
-			fmt.Printf("Scanning %s (%s) with %d ports at %s\n", args[0], ip, len(ports), time.Now().Format(time.RFC3339))
+			withService := banner || udp
+			printHost := func(i int) {
+				results := states[i].results
+				open := 0
+				// a map update per port is slow for hosts of all ports
+				for i := 0; i < len(results); {
+					j := i + 1
+					for j < len(results) && results[j].state == results[i].state {
+						j++
+					}
+					counts[results[i].state] += j - i
+					if results[i].state == scanOpen {
+						open += j - i
+					}
+					i = j
+				}
+				if !human {
+					reports = append(reports, newScanHostReport(hosts[i], results, verbose))
+				}
+				if checkpoint != "" {
+					if h := newScanCheckpointHost(hosts[i], results); h != nil {
+						finished = append(finished, h)
+					}
+				}
+				states[i].results = nil
+				if !human || open == 0 && !verbose {
+					return
+				}
+				fmt.Printf("\nHost: %s  Open: %d\n", hosts[i], open)
+				if withService {
+					fmt.Printf("%-5s  %-13s  %-12s  Service/Error\n", "Port", "State", "Duration")
+				} else {
+					fmt.Printf("%-5s  %-13s  Duration/Error\n", "Port", "State")
+				}
+				for _, r := range results {
+					switch {
+					case r.state == scanOpen && withService:
+						var service string
+						if r.banner != nil {
+							service = r.banner.String()
+						}
+						fmt.Printf("%-5d  %-13s  %-12v  %s\n", r.port, r.state, r.duration, service)
+					case r.state == scanOpen:
+						fmt.Printf("%-5d  %-13s  %v\n", r.port, r.state, r.duration)
+					case !verbose:
+					case withService:
+						fmt.Printf("%-5d  %-13s  %-12s  %s\n", r.port, r.state, "", errString(r.err))
+					default:
+						fmt.Printf("%-5d  %-13s  %s\n", r.port, r.state, errString(r.err))
+					}
+				}
+			}
+			flush := func() {
+				for next < started && states[next].remaining == 0 {
+					printHost(next)
+					next++
+				}
+			}
+			// startHost fills the ports of host i finished in the checkpoint and returns the indexes of ports to probe
+			startHost := func(i int) []int {
+				mu.Lock()
+				defer mu.Unlock()
+				st := &states[i]
+				st.results = make([]scanResult, len(ports))
+				st.remaining = len(ports)
+				if h, ok := restoredHosts[hosts[i].ip]; ok {
+					// already validated when counting
+					n, _ := h.apply(ports, st.results)
+					st.remaining -= n
+				}
+				var todo []int
+				for j, r := range st.results {
+					switch r.state {
+					case "":
+						todo = append(todo, j)
+					case scanOpen:
+						s.observe(hosts[i], r.duration)
+					}
+				}
+				started = i + 1
+				flush()
+				return todo
+			}
+			done := func(i, j int, r scanResult) {
+				mu.Lock()
+				defer mu.Unlock()
+				states[i].results[j] = r
+				states[i].remaining--
+				flush()
+			}
+
+			var (
+				saveMu sync.Mutex
+				// completed stops saving once the checkpoint is removed
+				completed bool
+			)
+			save := func() {
+				// the snapshot is taken under saveMu too, so a later save never writes older results
+				saveMu.Lock()
+				defer saveMu.Unlock()
+				if completed {
+					return
+				}
+				mu.Lock()
+				// finished is only appended, the capacity keeps appends from writing into the snapshot
+				c := finished[:len(finished):len(finished)]
+				for i := next; i < started; i++ {
+					if h := newScanCheckpointHost(hosts[i], states[i].results); h != nil {
+						c = append(c, h)
+					}
+				}
+				notStarted := hosts[started:]
+				mu.Unlock()
+				// hosts restored but not reached yet in this run
+				for _, host := range notStarted {
+					if h, ok := restoredHosts[host.ip]; ok {
+						c = append(c, h)
+					}
+				}
+				if err := saveScanCheckpoint(checkpoint, newScanCheckpoint(ports, udp, c)); err != nil {
+					logger.Warnln("save checkpoint:", err)
+				}
+			}
+			if checkpoint != "" {
+				ticker := time.NewTicker(scanCheckpointInterval)
+				defer ticker.Stop()
+				go func() {
+					for range ticker.C {
+						save()
+					}
+				}()
+				// 128+SIGINT like a shell, the scan is incomplete
+				onInterruptExit(func() {
+					save()
+					logger.Warnln("interrupted, checkpoint saved, continue with --checkpoint", checkpoint, "--resume")
+				}, 130)
+			}
+
 			var wg sync.WaitGroup
-			wg.Add(len(ports))
-			ch := make(chan struct{}, concurrency)
-			var success int32
-			fmt.Printf("%-5s  %-5s  Duration/Error\n", "Port", "Open")
+			ch := make(chan struct{}, max(concurrency, 1))
 			start := time.Now()
-			for _, p := range ports {
-				ch <- struct{}{}
-				go func(port int) {
-					defer func() {
-						<-ch
-						wg.Done()
-					}()
-					start := time.Now()
-					conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), timeout)
-					if err == nil {
-						defer conn.Close()
-						duration := time.Since(start)
-						atomic.AddInt32(&success, 1)
-						fmt.Printf("%-5d  true   %v\n", port, duration)
-					} else if verbose {
-						fmt.Printf("%-5d  false  %v\n", port, err)
-					}
-				}(p)
+			for i, host := range hosts {
+				for _, j := range startHost(i) {
+					ch <- struct{}{}
+					wg.Add(1)
+					go func(i, j int, host *scanHost, port int) {
+						defer func() {
+							<-ch
+							wg.Done()
+						}()
+						done(i, j, probe(host, port))
+					}(i, j, host, ports[j])
+				}
 			}
 			wg.Wait()
-			fmt.Printf("\nTotal Time: %v  Num: %d  Open: %d  Closed: %d", time.Since(start), len(ports), success, len(ports)-int(success))
 			close(ch)
+			// the checkpoint of a completed scan is of no use, it's removed once the results are written
+			removeCheckpoint := func() {
+				if checkpoint == "" {
+					return
+				}
+				saveMu.Lock()
+				defer saveMu.Unlock()
+				completed = true
+				if err := os.Remove(checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+					logger.Warnln("remove checkpoint:", err)
+				}
+			}
+			if !human {
+				if err := writeScanReport(os.Stdout, output, newScanReport(reports, ports, udp, start, time.Now())); err != nil {
+					if checkpoint != "" {
+						save()
+					}
+					return err
+				}
+				removeCheckpoint()
+				return nil
+			}
+			summary := fmt.Sprintf("\nTotal Time: %v  Hosts: %d  Num: %d  Open: %d  Closed: %d", time.Since(start), len(hosts), total, counts[scanOpen], counts[scanClosed])
+			if v := counts[scanFiltered]; v > 0 {
+				summary += fmt.Sprintf("  Filtered: %d", v)
+			}
+			if v := counts[scanOpenFiltered]; v > 0 {
+				summary += fmt.Sprintf("  Open|Filtered: %d", v)
+			}
+			if v := counts[scanProxyError]; v > 0 {
+				summary += fmt.Sprintf("  Proxy Error: %d", v)
+			}
+			fmt.Println(summary)
+			removeCheckpoint()
 			return nil
 		},
 	}
-	portScanCmd.Flags().StringVarP(&portRange, "port-range", "r", "", "port range, example: -r 1-100")
-	portScanCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 128, "maximum concurrency")
+	portScanCmd.Flags().StringVarP(&portRange, "port-range", "r", "", "port ranges, example: -r 1-100,443,8000-8100")
+	portScanCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 128, "maximum concurrency across all hosts and ports")
 	portScanCmd.Flags().IntSliceVarP(&ports, "port", "p", []int{}, "port to scan")
-	portScanCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "show closed ports")
-	portScanCmd.Flags().DurationVarP(&timeout, "timeout", "t", 6*time.Second, "connection timeout")
+	portScanCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "show closed and filtered ports")
+	portScanCmd.Flags().DurationVarP(&timeout, "timeout", "t", 6*time.Second, "initial and maximum connection timeout")
+	portScanCmd.Flags().StringVar(&inputList, "input-list", "", "read targets from file, one per line, also accepted as -iL")
+	portScanCmd.Flags().BoolVar(&banner, "banner", false, "read the greeting of open ports and identify the service, silent servers are nudged with HTTP HEAD and TLS ClientHello")
+	portScanCmd.Flags().DurationVar(&bannerWait, "banner-timeout", 2*time.Second, "time to wait for the greeting and each nudge")
+	portScanCmd.Flags().BoolVarP(&udp, "udp", "u", false, "udp scan, dns, ntp, snmp and stun ports get valid requests, others an empty packet")
+	portScanCmd.Flags().Float64Var(&rate, "rate", 0, "maximum connections or udp packets per second, nonpositive number means unlimited, default 100 for udp")
+	portScanCmd.Flags().IntVar(&retries, "retries", 0, "times to retry ports without answer")
+	portScanCmd.Flags().BoolVar(&adaptive, "adaptive", true, "adapt timeouts to the RTTs of open ports")
+	portScanCmd.Flags().IntVar(&topPorts, "top-ports", 0, fmt.Sprintf("scan the n most common ports, at most %d for tcp and %d for udp",
+		len(pkg.TopTCPPorts), len(pkg.TopUDPPorts)))
+	portScanCmd.Flags().StringVarP(&output, "output", "o", "", "machine-readable output sorted by host and port, json, csv or grepable, closed ports are included only with -v, which keeps every port of every host in memory")
+	portScanCmd.Flags().StringVar(&checkpoint, "checkpoint", "", "save finished ports to file every 10s and on interrupt, removed when the scan completes")
+	portScanCmd.Flags().BoolVar(&resume, "resume", false, "skip the ports finished in --checkpoint file")
+	portScanCmd.Flags().StringVar(&proxyURL, "proxy", "", "scan through comma separated proxy chain, eg. socks5h://10.0.0.1:1080, -p is taken by --port")
+	portScanCmd.AddCommand(scanDiffCmd)
 	rootCmd.AddCommand(portScanCmd)
 }
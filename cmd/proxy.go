@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"awake/pkg/proxy"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var proxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "Start socks5 and http proxy server",
+	Long:  "Start socks5 (CONNECT and UDP ASSOCIATE) and http (CONNECT and plain forwarding) proxy server on the same port",
+	Example: "  awake proxy --addr :1080\n  awake proxy --username admin --password 123456 --allow 10.0.0.0/8\n" +
+		"  awake proxy --upstream socks5h://10.0.0.1:1080",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		addr, _ := cmd.Flags().GetString("addr")
+		username, _ := cmd.Flags().GetString("username")
+		password, _ := cmd.Flags().GetString("password")
+		allow, _ := cmd.Flags().GetStringSlice("allow")
+		deny, _ := cmd.Flags().GetStringSlice("deny")
+		upstream, _ := cmd.Flags().GetString("upstream")
+		if username == "" && password != "" {
+			logger.Fatalln("password is set but username is empty")
+		}
+		srv := &proxy.Server{
+			Username: username,
+			Password: password,
+			Logger:   logger,
+		}
+		var err error
+		if srv.Allow, err = parseCIDRList(allow); err != nil {
+			logger.Fatalln(err)
+		}
+		if srv.Deny, err = parseCIDRList(deny); err != nil {
+			logger.Fatalln(err)
+		}
+		if upstream != "" {
+			if srv.Dialer, err = proxy.New(upstream); err != nil {
+				logger.Fatalln(err)
+			}
+			logger.Infoln("upstream proxy:", upstream)
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		logger.Infoln("socks5/http proxy server listen on", ln.Addr())
+		go func() {
+			quit := make(chan os.Signal, 1)
+			signal.Notify(quit, os.Interrupt)
+			<-quit
+			ln.Close()
+		}()
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Fatalln(err)
+		}
+		logger.Warnln("Server exiting")
+	},
+}
+
+// parseCIDRList parses cidr or ip list, ip is treated as a single host
+func parseCIDRList(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("invalid ip or cidr: " + s)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func init() {
+	proxyCmd.Flags().StringP("addr", "a", "127.0.0.1:1080", "listen address")
+	proxyCmd.Flags().String("username", "", "username for authentication, empty means no authentication")
+	proxyCmd.Flags().String("password", "", "password for authentication")
+	proxyCmd.Flags().StringSlice("allow", []string{}, "client ip or cidr allowed to connect, empty means all")
+	proxyCmd.Flags().StringSlice("deny", []string{}, "client ip or cidr denied to connect, takes precedence over --allow")
+	proxyCmd.Flags().String("upstream", "", "comma separated upstream proxy chain, eg. socks5h://10.0.0.1:1080,http://10.0.0.2:8080")
+	rootCmd.AddCommand(proxyCmd)
+}
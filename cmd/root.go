@@ -37,7 +37,24 @@ func init() {
 	rootCmd.PersistentFlags().String("level", "INFO", "log level, DEBUG INFO WARN ERROR FATAL")
 }
 
+// scanFlagAliases maps multi-letter single dash flags of scan which pflag can't parse, eg. nmap style -iL
+var scanFlagAliases = map[string]string{
+	"-iL": "--input-list",
+}
+
 func Execute() {
+	args := os.Args[1:]
+	if cmd, _, err := rootCmd.Find(args); err == nil && cmd.Parent() == rootCmd && cmd.Name() == "scan" {
+		for i, arg := range args {
+			if arg == "--" {
+				break
+			}
+			if v, ok := scanFlagAliases[arg]; ok {
+				args[i] = v
+			}
+		}
+	}
+	rootCmd.SetArgs(args)
 	err := rootCmd.Execute()
 	if err != nil {
 		os.Exit(1)
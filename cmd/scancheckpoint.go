@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"awake/pkg"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// scanCheckpointInterval is how often the checkpoint is saved while scanning
+const scanCheckpointInterval = 10 * time.Second
+
+// scanCheckpoint records finished host/port pairs, closed and filtered ports are kept as ranges
+// so that a full range scan of many hosts stays small
+type scanCheckpoint struct {
+	Protocol string                `json:"protocol"`
+	Ports    string                `json:"ports"`
+	Updated  time.Time             `json:"updated"`
+	Hosts    []*scanCheckpointHost `json:"hosts"`
+}
+
+type scanCheckpointHost struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+	// States are finished ports other than open in ranges by state, eg. {"closed": "1-21,23-79"}
+	States map[string]string `json:"states,omitempty"`
+	Open   []*scanPortReport `json:"open,omitempty"`
+}
+
+func newScanCheckpoint(ports []int, udp bool, hosts []*scanCheckpointHost) *scanCheckpoint {
+	c := &scanCheckpoint{Protocol: "tcp", Ports: formatPortRanges(ports), Updated: time.Now(), Hosts: hosts}
+	if udp {
+		c.Protocol = "udp"
+	}
+	return c
+}
+
+// newScanCheckpointHost compacts the finished results of the host, nil if none is finished
+func newScanCheckpointHost(host *scanHost, results []scanResult) *scanCheckpointHost {
+	h := &scanCheckpointHost{Name: host.name, IP: host.ip}
+	// ports are sorted, consecutive ports of the same state are a range
+	byState := make(map[string][]string)
+	for i := 0; i < len(results); {
+		r := results[i]
+		if r.state == scanOpen {
+			h.Open = append(h.Open, newScanPortReport(r))
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(results) && results[j].state == r.state && results[j].port == results[j-1].port+1 {
+			j++
+		}
+		// an empty state is not finished
+		if r.state != "" {
+			byState[r.state] = append(byState[r.state], formatPortRange(r.port, results[j-1].port))
+		}
+		i = j
+	}
+	if len(byState) == 0 && len(h.Open) == 0 {
+		return nil
+	}
+	h.States = make(map[string]string)
+	for state, v := range byState {
+		h.States[state] = strings.Join(v, ",")
+	}
+	return h
+}
+
+// index returns the hosts by ip
+func (c *scanCheckpoint) index() map[string]*scanCheckpointHost {
+	m := make(map[string]*scanCheckpointHost, len(c.Hosts))
+	for _, h := range c.Hosts {
+		m[h.IP] = h
+	}
+	return m
+}
+
+// apply fills results of the sorted ports with the ports finished in the checkpoint and returns how many,
+// results can be nil to only count them. Ranges are never expanded, so a host with every port closed is cheap.
+func (h *scanCheckpointHost) apply(ports []int, results []scanResult) (int, error) {
+	n := 0
+	for state, ranges := range h.States {
+		err := pkg.RangePortRanges(ranges, func(start, end int) {
+			lo, hi := sort.SearchInts(ports, start), sort.SearchInts(ports, end+1)
+			n += max(hi-lo, 0)
+			for j := lo; j < hi && results != nil; j++ {
+				results[j] = scanResult{port: ports[j], state: state}
+			}
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, p := range h.Open {
+		if j := sort.SearchInts(ports, p.Port); j < len(ports) && ports[j] == p.Port {
+			if results != nil {
+				results[j] = p.result()
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// saveScanCheckpoint writes to a temporary file and renames it, so that a crash never leaves a broken checkpoint
+func saveScanCheckpoint(file string, c *scanCheckpoint) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func loadScanCheckpoint(file string) (*scanCheckpoint, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var c scanCheckpoint
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return &c, nil
+}
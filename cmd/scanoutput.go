@@ -0,0 +1,286 @@
+package cmd
+
+import (
+	"awake/pkg"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scanReport is the machine-readable result of a scan, also the input of scan diff
+type scanReport struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Elapsed  float64   `json:"elapsed_ms"`
+	Protocol string    `json:"protocol"`
+	// Ports are the scanned ports in ranges, eg. 1-1024,3306
+	Ports string            `json:"ports"`
+	Hosts []*scanHostReport `json:"hosts"`
+}
+
+type scanHostReport struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+	Open int    `json:"open"`
+	// Ports are open ports, and other ports only if verbose
+	Ports []*scanPortReport `json:"ports"`
+}
+
+type scanPortReport struct {
+	Port      int       `json:"port"`
+	State     string    `json:"state"`
+	RTT       float64   `json:"rtt_ms,omitempty"`
+	Service   string    `json:"service,omitempty"`
+	Info      string    `json:"info,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	ScannedAt time.Time `json:"scanned_at"`
+}
+
+func newScanPortReport(r scanResult) *scanPortReport {
+	p := &scanPortReport{Port: r.port, State: r.state, ScannedAt: r.at}
+	if r.state == scanOpen {
+		p.RTT = durationMs(r.duration)
+	}
+	if r.banner != nil {
+		p.Service, p.Info = r.banner.Service, r.banner.Info
+	}
+	if r.err != nil {
+		p.Error = r.err.Error()
+	}
+	return p
+}
+
+// result converts the report back, the error keeps only its message
+func (p *scanPortReport) result() scanResult {
+	r := scanResult{
+		port:     p.Port,
+		state:    p.State,
+		at:       p.ScannedAt,
+		duration: time.Duration(p.RTT * float64(time.Millisecond)),
+	}
+	if p.Service != "" || p.Info != "" {
+		r.banner = &pkg.Banner{Service: p.Service, Info: p.Info}
+	}
+	if p.Error != "" {
+		r.err = errors.New(p.Error)
+	}
+	return r
+}
+
+// formatPortRanges joins sorted ports to ranges, eg. 1-1024,3306
+func formatPortRanges(ports []int) string {
+	var parts []string
+	for i := 0; i < len(ports); {
+		j := i
+		for j+1 < len(ports) && ports[j+1] == ports[j]+1 {
+			j++
+		}
+		parts = append(parts, formatPortRange(ports[i], ports[j]))
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+func formatPortRange(first, last int) string {
+	if first == last {
+		return strconv.Itoa(first)
+	}
+	return strconv.Itoa(first) + "-" + strconv.Itoa(last)
+}
+
+// newScanHostReport lists the open ports of the host, and the other ports only if verbose
+func newScanHostReport(host *scanHost, results []scanResult, verbose bool) *scanHostReport {
+	h := &scanHostReport{Name: host.name, IP: host.ip, Ports: []*scanPortReport{}}
+	for _, r := range results {
+		if r.state == scanOpen {
+			h.Open++
+		} else if !verbose {
+			continue
+		}
+		h.Ports = append(h.Ports, newScanPortReport(r))
+	}
+	return h
+}
+
+func newScanReport(hosts []*scanHostReport, ports []int, udp bool, start, end time.Time) *scanReport {
+	report := &scanReport{
+		Start:    start,
+		End:      end,
+		Elapsed:  durationMs(end.Sub(start)),
+		Protocol: "tcp",
+		Ports:    formatPortRanges(ports),
+		Hosts:    hosts,
+	}
+	if udp {
+		report.Protocol = "udp"
+	}
+	sort.SliceStable(report.Hosts, func(i, j int) bool {
+		a, errA := netip.ParseAddr(report.Hosts[i].IP)
+		b, errB := netip.ParseAddr(report.Hosts[j].IP)
+		if errA != nil || errB != nil {
+			return report.Hosts[i].IP < report.Hosts[j].IP
+		}
+		return a.Less(b)
+	})
+	return report
+}
+
+func writeScanReport(w io.Writer, format string, report *scanReport) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"host", "ip", "protocol", "port", "state", "rtt_ms", "service", "info", "error", "scanned_at"})
+		for _, h := range report.Hosts {
+			for _, p := range h.Ports {
+				rtt := ""
+				if p.State == scanOpen {
+					rtt = formatMs(p.RTT)
+				}
+				cw.Write([]string{h.Name, h.IP, report.Protocol, strconv.Itoa(p.Port), p.State, rtt,
+					p.Service, p.Info, p.Error, p.ScannedAt.Format(time.RFC3339Nano)})
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case "grepable":
+		// one line per host like nmap -oG, fields of a port are port/state/protocol/service/info
+		field := func(s string) string {
+			return strings.NewReplacer("/", "|", ",", ";", "\t", " ").Replace(s)
+		}
+		fmt.Fprintf(w, "# awake scan started at %s, %s ports %s\n", report.Start.Format(time.RFC3339), report.Protocol, report.Ports)
+		for _, h := range report.Hosts {
+			var ports []string
+			for _, p := range h.Ports {
+				ports = append(ports, fmt.Sprintf("%d/%s/%s/%s/%s", p.Port, p.State, report.Protocol, field(p.Service), field(p.Info)))
+			}
+			fmt.Fprintf(w, "Host: %s (%s)\tOpen: %d\tPorts: %s\n", h.IP, h.Name, h.Open, strings.Join(ports, ", "))
+		}
+		_, err := fmt.Fprintf(w, "# awake scan done at %s, %d hosts scanned in %.3f seconds\n",
+			report.End.Format(time.RFC3339), len(report.Hosts), report.Elapsed/1000)
+		return err
+	default:
+		return fmt.Errorf("unsupported output format: %s, must be json, csv or grepable", format)
+	}
+}
+
+func readScanReport(file string) (*scanReport, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var report scanReport
+	if err := json.Unmarshal(b, &report); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return &report, nil
+}
+
+// diffScanReports returns the lines of ports that opened or closed sorted by host and port,
+// ports not scanned by both are ignored and hosts only in one of them are noted
+func diffScanReports(old, new *scanReport) ([]string, error) {
+	if old.Protocol != new.Protocol {
+		return nil, fmt.Errorf("protocol mismatch: %s and %s", old.Protocol, new.Protocol)
+	}
+	oldPorts, err := pkg.ParsePortRanges(old.Ports)
+	if err != nil {
+		return nil, err
+	}
+	newPorts, err := pkg.ParsePortRanges(new.Ports)
+	if err != nil {
+		return nil, err
+	}
+	scannedByBoth := make(map[int]bool)
+	for _, p := range oldPorts {
+		scannedByBoth[p] = false
+	}
+	for _, p := range newPorts {
+		if _, ok := scannedByBoth[p]; ok {
+			scannedByBoth[p] = true
+		}
+	}
+	index := func(r *scanReport) map[string]*scanHostReport {
+		m := make(map[string]*scanHostReport)
+		for _, h := range r.Hosts {
+			m[h.IP] = h
+		}
+		return m
+	}
+	oldHosts, newHosts := index(old), index(new)
+	// state of a port not listed in the report, only open ports are listed unless verbose
+	state := func(h *scanHostReport, port int) string {
+		for _, p := range h.Ports {
+			if p.Port == port {
+				return p.State
+			}
+		}
+		return "not open"
+	}
+	type change struct {
+		ip   netip.Addr
+		port int
+		line string
+	}
+	var changes []change
+	add := func(ip string, port int, line string) {
+		addr, _ := netip.ParseAddr(ip)
+		changes = append(changes, change{addr, port, line})
+	}
+	for _, h := range new.Hosts {
+		o, ok := oldHosts[h.IP]
+		if !ok {
+			// eg. a name resolves to another address now
+			add(h.IP, -1, fmt.Sprintf("? %s (%s) only in new scan, %d open", h.IP, h.Name, h.Open))
+			continue
+		}
+		for _, p := range h.Ports {
+			if p.State != scanOpen || !scannedByBoth[p.Port] {
+				continue
+			}
+			if was := state(o, p.Port); was != scanOpen {
+				line := fmt.Sprintf("+ %s (%s) %d/%s opened, was %s", h.IP, h.Name, p.Port, new.Protocol, was)
+				if p.Service != "" || p.Info != "" {
+					line += fmt.Sprintf(" [%s]", strings.TrimSpace(p.Service+" "+p.Info))
+				}
+				add(h.IP, p.Port, line)
+			}
+		}
+	}
+	for _, o := range old.Hosts {
+		h, ok := newHosts[o.IP]
+		if !ok {
+			add(o.IP, -1, fmt.Sprintf("? %s (%s) only in old scan, %d open", o.IP, o.Name, o.Open))
+			continue
+		}
+		for _, p := range o.Ports {
+			if p.State != scanOpen || !scannedByBoth[p.Port] {
+				continue
+			}
+			if now := state(h, p.Port); now != scanOpen {
+				add(o.IP, p.Port, fmt.Sprintf("- %s (%s) %d/%s closed, now %s", o.IP, o.Name, p.Port, new.Protocol, now))
+			}
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].ip != changes[j].ip {
+			return changes[i].ip.Less(changes[j].ip)
+		}
+		return changes[i].port < changes[j].port
+	})
+	lines := make([]string, 0, len(changes))
+	for _, c := range changes {
+		lines = append(lines, c.line)
+	}
+	return lines, nil
+}
@@ -0,0 +1,354 @@
+package cmd
+
+import (
+	"awake/pkg"
+	"awake/pkg/proxy"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	scanOpen         = "open"
+	scanClosed       = "closed"
+	scanFiltered     = "filtered"
+	scanOpenFiltered = "open|filtered"
+	// scanProxyError means the proxy failed without telling the state of the port
+	scanProxyError = "proxy-error"
+)
+
+// udp probes are paced by default, the kernel rate limits ICMP unreachable and a flood makes closed ports look open|filtered
+const udpScanRate = 100
+
+// minScanTimeout is the lower bound of adaptive timeouts
+const minScanTimeout = 250 * time.Millisecond
+
+type scanResult struct {
+	port     int
+	state    string
+	at       time.Time
+	duration time.Duration
+	err      error
+	banner   *pkg.Banner
+}
+
+type scanner struct {
+	// timeout is the initial and maximum timeout
+	timeout    time.Duration
+	adaptive   bool
+	retries    int
+	banner     bool
+	bannerWait time.Duration
+	// proxy is the proxy chain to dial through, empty means direct
+	proxy string
+	// limiter paces every connection and packet including retries, nil means unlimited
+	limiter *tokenBucket
+	// rtt is shared by all hosts, used before a host has any open port
+	rtt rttEstimator
+}
+
+// rttEstimator derives timeouts from RTTs of open ports like TCP RTO, https://www.rfc-editor.org/rfc/rfc6298
+type rttEstimator struct {
+	mu      sync.Mutex
+	srtt    time.Duration
+	rttvar  time.Duration
+	samples int
+}
+
+func (e *rttEstimator) add(rtt time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.samples == 0 {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+	} else {
+		diff := e.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		e.rttvar = (3*e.rttvar + diff) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+	e.samples++
+}
+
+// timeout returns srtt + 4 * rttvar, ok is false if there is no sample
+func (e *rttEstimator) timeout() (time.Duration, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.srtt + 4*e.rttvar, e.samples > 0
+}
+
+// timeoutFor returns the timeout of the attempt, starting from the estimate of the host and doubled on each retry
+func (s *scanner) timeoutFor(host *scanHost, attempt int) time.Duration {
+	if !s.adaptive {
+		return s.timeout
+	}
+	t, ok := host.rtt.timeout()
+	if !ok {
+		if t, ok = s.rtt.timeout(); !ok {
+			return s.timeout
+		}
+	}
+	t = max(t, minScanTimeout)
+	for i := 0; i < attempt && t < s.timeout; i++ {
+		t *= 2
+	}
+	return min(t, s.timeout)
+}
+
+func (s *scanner) wait() {
+	if s.limiter != nil {
+		s.limiter.Wait()
+	}
+}
+
+func (s *scanner) observe(host *scanHost, rtt time.Duration) {
+	host.rtt.add(rtt)
+	s.rtt.add(rtt)
+}
+
+// probeTCP retries if there is no answer, closed ports answer with RST at once
+func (s *scanner) probeTCP(host *scanHost, port int) scanResult {
+	var r scanResult
+	for attempt := 0; attempt <= s.retries; attempt++ {
+		r = s.dialTCP(host, port, s.timeoutFor(host, attempt))
+		if r.state != scanFiltered {
+			break
+		}
+	}
+	return r
+}
+
+// probeUDP retries if there is no answer, a lost request or response looks the same as open|filtered
+func (s *scanner) probeUDP(host *scanHost, port int) scanResult {
+	var r scanResult
+	for attempt := 0; attempt <= s.retries; attempt++ {
+		r = s.sendUDP(host, port, s.timeoutFor(host, attempt))
+		if r.state != scanOpenFiltered {
+			break
+		}
+	}
+	return r
+}
+
+// errString returns the message of err, empty for nil, eg. the error of a port restored from checkpoint is not kept
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func (s *scanner) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	if s.proxy != "" {
+		return dialTCPWithProxy(context.Background(), s.proxy, addr, timeout)
+	}
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// dialState classifies a failed tcp dial, through a proxy the port is closed or filtered
+// only if the proxy tells so, or the proxy doesn't answer in time while connecting to the target
+func (s *scanner) dialState(err error) string {
+	var replyErr *proxy.ReplyError
+	if errors.As(err, &replyErr) {
+		switch {
+		case replyErr.Refused():
+			return scanClosed
+		case replyErr.Unreachable():
+			return scanFiltered
+		default:
+			return scanProxyError
+		}
+	}
+	var netErr net.Error
+	switch {
+	case errors.Is(err, proxy.ErrProtocol):
+		// the proxy is broken, eg. it speaks another protocol or didn't answer the greeting
+		return scanProxyError
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return scanFiltered
+	case s.proxy != "":
+		// eg. the proxy refused us or closed the connection
+		return scanProxyError
+	case isConnRefused(err):
+		return scanClosed
+	default:
+		return scanFiltered
+	}
+}
+
+// checkScanProxy asks the proxy chain to connect to the last proxy itself, which is answered at once whatever
+// the targets are, so that an unreachable proxy or one speaking another protocol fails the scan instead of every port
+func checkScanProxy(proxyURL string, timeout time.Duration) error {
+	dialer, err := proxy.New(proxyURL)
+	if err != nil {
+		return err
+	}
+	if len(dialer.Chain) == 0 {
+		return errors.New("empty proxy")
+	}
+	dialer.Timeout = timeout
+	conn, err := dialer.Dial("tcp", dialer.Chain[len(dialer.Chain)-1].Host)
+	var replyErr *proxy.ReplyError
+	if errors.As(err, &replyErr) {
+		// any reply tells the proxy works
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("proxy check failed: no answer in %v, check the proxy scheme", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("proxy check failed: %w", err)
+	}
+	return conn.Close()
+}
+
+// isConnRefused reports whether err is caused by TCP RST or ICMP port unreachable
+func isConnRefused(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	// 10061 is WSAECONNREFUSED on windows
+	return errno == syscall.ECONNREFUSED || errno == 10061
+}
+
+func (s *scanner) dialTCP(host *scanHost, port int, timeout time.Duration) scanResult {
+	r := scanResult{port: port}
+	addr := net.JoinHostPort(host.ip, strconv.Itoa(port))
+	s.wait()
+	start := time.Now()
+	r.at = start
+	conn, err := s.dial(addr, timeout)
+	if err != nil {
+		r.err = err
+		r.state = s.dialState(err)
+		return r
+	}
+	r.state = scanOpen
+	r.duration = time.Since(start)
+	s.observe(host, r.duration)
+	if !s.banner {
+		conn.Close()
+		return r
+	}
+	redial := func() (net.Conn, error) {
+		// the redial is a connection like any other and is paced by --rate too
+		s.wait()
+		return s.dial(addr, s.timeout)
+	}
+	var serverName string
+	if !pkg.IsIP(host.name) {
+		serverName = host.name
+	}
+	r.banner = pkg.GrabBanner(conn, redial, serverName, s.bannerWait)
+	return r
+}
+
+// udpScanQuery returns the payload for well-known ports, other ports get an empty packet
+func udpScanQuery(port int) (string, pkg.UDPQuery) {
+	var kind string
+	switch port {
+	case 53:
+		kind = "dns"
+	case 123:
+		kind = "ntp"
+	case 161:
+		kind = "snmp"
+	case 3478:
+		kind = "stun"
+	default:
+		return "", &rawQuery{}
+	}
+	query, err := pkg.NewUDPQuery(kind, "example.com")
+	if err != nil {
+		panic(err)
+	}
+	return kind, query
+}
+
+// sendUDP classifies the port as open if any response arrives, closed if ICMP port unreachable is reported
+// on the connected socket, and open|filtered if nothing comes back
+func (s *scanner) sendUDP(host *scanHost, port int, timeout time.Duration) scanResult {
+	r := scanResult{port: port}
+	addr := net.JoinHostPort(host.ip, strconv.Itoa(port))
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		r.state = scanFiltered
+		r.err = err
+		return r
+	}
+	defer conn.Close()
+	kind, query := udpScanQuery(port)
+	s.wait()
+	start := time.Now()
+	r.at = start
+	_, err = conn.Write(query.Request())
+	if err == nil {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		buf := make([]byte, 4096)
+		var n int
+		n, err = conn.Read(buf)
+		if err == nil {
+			r.state = scanOpen
+			r.duration = time.Since(start)
+			s.observe(host, r.duration)
+			r.banner = &pkg.Banner{Service: kind, Info: fmt.Sprintf("%d bytes", n)}
+			if kind != "" {
+				if answer, err := query.Parse(buf[:n]); err == nil {
+					r.banner.Info = answer
+				}
+			}
+			return r
+		}
+	}
+	var netErr net.Error
+	switch {
+	case isConnRefused(err):
+		r.state = scanClosed
+		r.err = err
+	case errors.As(err, &netErr) && netErr.Timeout():
+		r.state = scanOpenFiltered
+		r.err = errors.New("no response")
+	default:
+		// eg. ICMP host unreachable
+		r.state = scanFiltered
+		r.err = err
+	}
+	return r
+}
+
+// tokenBucket allows rate events per second on average with bursts up to burst
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Wait blocks until a token is available
+func (b *tokenBucket) Wait() {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	// the token is reserved now, so concurrent callers queue up behind it
+	b.tokens--
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	time.Sleep(wait)
+}
@@ -1,98 +1,558 @@
 package cmd
 
 import (
+	"awake/pkg/proxy"
+	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/mattn/go-isatty"
 	"github.com/spf13/cobra"
 )
 
 var tcpingCmd = &cobra.Command{
-	Use:   "tcping",
-	Short: "Tcping",
-	Args:  cobra.ExactArgs(1),
+	Use:     "tcping",
+	Short:   "Tcping",
+	Example: "  awake tcping 1.1.1.1:443\n  awake tcping host1:22 https://host2 -c 10\n  awake tcping -f targets.txt -c 0",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		n, _ := cmd.Flags().GetInt("count")
 		interval, _ := cmd.Flags().GetDuration("interval")
+		file, _ := cmd.Flags().GetString("file")
+		output, _ := cmd.Flags().GetString("output")
 		if interval < time.Millisecond*250 {
 			return errors.New("interval too small, minimum 250ms")
 		}
-		if u, err := url.Parse(args[0]); err == nil {
-			host, port := u.Hostname(), u.Port()
-			if port == "" {
-				if u.Scheme == "https" {
-					port = "443"
-				} else if u.Scheme == "http" {
-					port = "80"
-				}
+		names := args
+		if file != "" {
+			v, err := readTargetsFile(file)
+			if err != nil {
+				return err
+			}
+			names = append(names, v...)
+		}
+		if len(names) == 0 {
+			return errors.New("no target, specify targets as arguments or use --file")
+		}
+		opts := &tcpingOptions{}
+		opts.proxy, _ = cmd.Flags().GetString("proxy")
+		opts.tls, _ = cmd.Flags().GetBool("tls")
+		opts.http, _ = cmd.Flags().GetBool("http")
+		opts.insecure, _ = cmd.Flags().GetBool("insecure")
+		opts.timeout, _ = cmd.Flags().GetDuration("timeout")
+		opts.resolveEvery, _ = cmd.Flags().GetBool("resolve-every")
+		ipv4, _ := cmd.Flags().GetBool("ipv4")
+		ipv6, _ := cmd.Flags().GetBool("ipv6")
+		source, _ := cmd.Flags().GetString("source")
+		if opts.timeout <= 0 {
+			return errors.New("timeout must be positive")
+		}
+		opts.network = "tcp"
+		if ipv4 && ipv6 {
+			return errors.New("-4 and -6 are mutually exclusive")
+		} else if ipv4 {
+			opts.network = "tcp4"
+		} else if ipv6 {
+			opts.network = "tcp6"
+		}
+		if source != "" {
+			ip, err := resolveSourceIP(source, opts.network)
+			if err != nil {
+				return err
 			}
-			if host != "" && port != "" {
-				args[0] = net.JoinHostPort(host, port)
+			opts.source = ip
+		}
+		targets := make([]*tcpingTarget, 0, len(names))
+		for _, name := range names {
+			t, err := newTcpingTarget(name, opts)
+			if err != nil {
+				return err
 			}
+			targets = append(targets, t)
 		}
-		tcpAddr, err := net.ResolveTCPAddr("tcp", args[0])
+		if output != "" {
+			w, err := newPingRecordWriter(os.Stdout, output)
+			if err != nil {
+				return err
+			}
+			return tcpingRecords(targets, n, interval, w)
+		}
+		if len(targets) == 1 {
+			return tcpingOne(targets[0], n, interval)
+		}
+		return tcpingMany(targets, n, interval)
+	},
+}
+
+// readTargetsFile reads one target per line, blank lines and lines starting with # are ignored
+func readTargetsFile(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var targets []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		targets = append(targets, strings.Fields(line)...)
+	}
+	return targets, scanner.Err()
+}
+
+type tcpingOptions struct {
+	proxy    string
+	tls      bool
+	http     bool
+	insecure bool
+	// timeout of every probe including all phases
+	timeout time.Duration
+	// network is tcp, tcp4 or tcp6
+	network      string
+	source       net.IP
+	resolveEvery bool
+}
+
+type tcpingTarget struct {
+	name string
+	// host:port to dial
+	hostport string
+	// path for http probe
+	path string
+	// tls is enabled for https url even without --tls
+	tls  bool
+	addr string
+	opts *tcpingOptions
+
+	mu      sync.Mutex
+	stats   pingStats
+	last    time.Duration
+	lastErr error
+	// dns is the duration of the last resolution which has not been reported by a probe
+	dns time.Duration
+}
+
+func newTcpingTarget(name string, opts *tcpingOptions) (*tcpingTarget, error) {
+	t := &tcpingTarget{name: name, hostport: name, path: "/", opts: opts, tls: opts.tls}
+	if u, err := url.Parse(name); err == nil && u.Host != "" {
+		host, port := u.Hostname(), u.Port()
+		if port == "" {
+			if u.Scheme == "https" {
+				port = "443"
+			} else if u.Scheme == "http" {
+				port = "80"
+			}
+		}
+		if host != "" && port != "" {
+			t.hostport = net.JoinHostPort(host, port)
+		}
+		if u.RequestURI() != "" {
+			t.path = u.RequestURI()
+		}
+		if u.Scheme == "https" && opts.http {
+			t.tls = true
+		}
+	}
+	if _, _, err := net.SplitHostPort(t.hostport); err != nil {
+		return nil, err
+	}
+	if opts.proxy != "" {
+		// the proxy resolves or receives the name, dns is not measured
+		t.addr = t.hostport
+		return t, nil
+	}
+	return t, t.resolve()
+}
+
+func (t *tcpingTarget) resolve() error {
+	start := time.Now()
+	tcpAddr, err := net.ResolveTCPAddr(t.opts.network, t.hostport)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.addr = tcpAddr.String()
+	t.dns = time.Since(start)
+	t.mu.Unlock()
+	return nil
+}
+
+// tcpingResult is the result of one probe, zero duration means the phase was not measured
+type tcpingResult struct {
+	at      time.Time
+	addr    string
+	dns     time.Duration
+	connect time.Duration
+	tls     time.Duration
+	ttfb    time.Duration
+	status  int
+	err     error
+}
+
+// total is the rtt used by statistics, dns is excluded because names are resolved before probing
+func (r *tcpingResult) total() time.Duration {
+	return r.connect + r.tls + r.ttfb
+}
+
+func (r *tcpingResult) String() string {
+	buf := &strings.Builder{}
+	if r.dns > 0 {
+		fmt.Fprintf(buf, "dns=%s ", r.dns)
+	}
+	if r.tls > 0 || r.ttfb > 0 {
+		fmt.Fprintf(buf, "connect=%s ", r.connect)
+	}
+	if r.tls > 0 {
+		fmt.Fprintf(buf, "tls=%s ", r.tls)
+	}
+	if r.ttfb > 0 {
+		fmt.Fprintf(buf, "ttfb=%s status=%d ", r.ttfb, r.status)
+	}
+	fmt.Fprintf(buf, "time=%s", r.total())
+	return buf.String()
+}
+
+// probe re-resolves the name if needed, then dials
+func (t *tcpingTarget) probe(seq int) *tcpingResult {
+	at := time.Now()
+	var err error
+	if t.opts.resolveEvery && t.opts.proxy == "" && seq > 1 {
+		err = t.resolve()
+	}
+	t.mu.Lock()
+	r := &tcpingResult{at: at, addr: t.addr, dns: t.dns}
+	t.dns = 0
+	t.mu.Unlock()
+	if err != nil {
+		r.err = err
+	} else {
+		r.err = t.dial(r.addr, r)
+	}
+	t.mu.Lock()
+	t.stats.add(r.total(), r.err == nil)
+	t.last, t.lastErr = r.total(), r.err
+	t.mu.Unlock()
+	return r
+}
+
+// dial connects to addr and measures every phase into r
+func (t *tcpingTarget) dial(addr string, r *tcpingResult) error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.opts.timeout)
+	defer cancel()
+	dialer := &net.Dialer{}
+	if t.opts.source != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: t.opts.source}
+	}
+	start := time.Now()
+	var (
+		conn net.Conn
+		err  error
+	)
+	if t.opts.proxy != "" {
+		var pd *proxy.Dialer
+		pd, err = newProxyDialer(t.opts.proxy)
+		if err == nil {
+			pd.Forward = dialer
+			conn, err = pd.DialContext(ctx, t.opts.network, addr)
+		}
+	} else {
+		conn, err = dialer.DialContext(ctx, t.opts.network, addr)
+	}
+	r.connect = time.Since(start)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	host, _, _ := net.SplitHostPort(t.hostport)
+	if t.tls {
+		start = time.Now()
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: t.opts.insecure,
+			NextProtos:         []string{"http/1.1"},
+		})
+		err = tlsConn.HandshakeContext(ctx)
+		r.tls = time.Since(start)
 		if err != nil {
 			return err
 		}
-		addr := tcpAddr.String()
-		fmt.Printf("Tcpinging %s (%s) :\n", args[0], addr)
-		infinite := n <= 0
-		i := 0
-		var total, success int64
-		var min, max, sum time.Duration
-		printStats := func() {
-			var avg time.Duration
-			if success != 0 {
-				avg = sum / time.Duration(success)
-			}
-			fmt.Printf("\nTotal = %d, Success = %d, Fail = %d, Pass Percentage = %.1f%%\nMin = %v, Max = %v, Avg = %v\n",
-				total, success, total-success, float64(success)/float64(total)*100, min, max, avg)
+		conn = tlsConn
+	}
+	if t.opts.http {
+		start = time.Now()
+		_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: awake\r\nAccept: */*\r\nConnection: close\r\n\r\n",
+			t.path, t.hostport)
+		if err != nil {
+			return err
+		}
+		br := bufio.NewReader(conn)
+		if _, err = br.Peek(1); err != nil {
+			return err
+		}
+		r.ttfb = time.Since(start)
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		// HTTP/1.1 200 OK
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+			return fmt.Errorf("invalid http response: %q", strings.TrimSpace(line))
+		}
+		if r.status, err = strconv.Atoi(fields[1]); err != nil {
+			return fmt.Errorf("invalid http status: %q", fields[1])
+		}
+	}
+	return nil
+}
+
+// resolveSourceIP parses source as an ip, or picks the first address of the interface named source
+func resolveSourceIP(source string, network string) (net.IP, error) {
+	if ip := net.ParseIP(source); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(source)
+	if err != nil {
+		return nil, fmt.Errorf("source %s is neither an ip nor an interface: %w", source, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		isV4 := ipNet.IP.To4() != nil
+		if network == "tcp" || (network == "tcp4" && isV4) || (network == "tcp6" && !isV4) {
+			return ipNet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("no usable address on interface %s", source)
+}
+
+// onInterrupt calls f and exits when SIGINT is received
+func onInterrupt(f func()) {
+	onInterruptExit(f, 0)
+}
+
+// onInterruptExit calls f and exits with code when SIGINT is received
+func onInterruptExit(f func(), code int) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT)
+	go func() {
+		<-sigChan
+		f()
+		os.Exit(code)
+	}()
+}
+
+func tcpingOne(t *tcpingTarget, n int, interval time.Duration) error {
+	fmt.Printf("Tcpinging %s (%s) :\n", t.name, t.addr)
+	printStats := func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		fmt.Printf("\n%s\n", &t.stats)
+	}
+	onInterrupt(printStats)
+	defer printStats()
+	infinite := n <= 0
+	for i := 1; ; i++ {
+		r := t.probe(i)
+		if r.err != nil {
+			fmt.Printf("Unexpected error: %s\n", r.err)
+		} else {
+			fmt.Printf("Connected %s : %s\n", r.addr, r)
+		}
+		if infinite || i < n {
+			time.Sleep(interval)
+		} else {
+			return nil
+		}
+	}
+}
+
+// tcpingMany probes all targets concurrently, the table is refreshed in place if stdout is a terminal
+func tcpingMany(targets []*tcpingTarget, n int, interval time.Duration) error {
+	isTerm := os.Getenv("TERM") != "dumb" && (isatty.IsTerminal(os.Stdout.Fd()) || isatty.IsCygwinTerminal(os.Stdout.Fd()))
+	fmt.Printf("Tcpinging %d targets :\n", len(targets))
+	var outputMu sync.Mutex
+	drawn := false
+	draw := func() {
+		if drawn {
+			fmt.Printf("\033[%dA", len(targets)+1)
+		}
+		drawn = true
+		fmt.Print(formatTcpingTable(targets, isTerm))
+	}
+	printStats := func() {
+		outputMu.Lock()
+		defer outputMu.Unlock()
+		if isTerm {
+			draw()
+		}
+		for _, t := range targets {
+			t.mu.Lock()
+			fmt.Printf("\n--- %s (%s) ---\n%s\n", t.name, t.addr, &t.stats)
+			t.mu.Unlock()
+		}
+	}
+	onInterrupt(printStats)
+	defer printStats()
+
+	done := runTcpingProbes(targets, n, interval, func(t *tcpingTarget, seq int, r *tcpingResult) {
+		if isTerm {
+			return
+		}
+		outputMu.Lock()
+		defer outputMu.Unlock()
+		if r.err != nil {
+			fmt.Printf("%s : Unexpected error: %s\n", t.name, r.err)
+		} else {
+			fmt.Printf("%s : Connected %s : %s\n", t.name, r.addr, r)
 		}
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGINT)
+	})
+	if !isTerm {
+		<-done
+		return nil
+	}
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			outputMu.Lock()
+			draw()
+			outputMu.Unlock()
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// tcpingRecords writes machine-readable records instead of the human-readable output
+func tcpingRecords(targets []*tcpingTarget, n int, interval time.Duration, w *pingRecordWriter) error {
+	printStats := func() {
+		for _, t := range targets {
+			t.mu.Lock()
+			w.summary(t.name, t.addr, &t.stats)
+			t.mu.Unlock()
+		}
+	}
+	onInterrupt(printStats)
+	<-runTcpingProbes(targets, n, interval, func(t *tcpingTarget, seq int, r *tcpingResult) {
+		rec := newPingProbeRecord(t.name, r.addr, seq, r.at, r.total(), r.err)
+		rec.DNS = durationMs(r.dns)
+		rec.Connect = durationMs(r.connect)
+		rec.TLS = durationMs(r.tls)
+		rec.TTFB = durationMs(r.ttfb)
+		rec.Status = r.status
+		w.probe(rec)
+	})
+	printStats()
+	return nil
+}
+
+// runTcpingProbes probes every target n times concurrently, the returned channel is closed when all are done
+func runTcpingProbes(targets []*tcpingTarget, n int, interval time.Duration,
+	onResult func(t *tcpingTarget, seq int, r *tcpingResult)) <-chan struct{} {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(len(targets))
+	for _, t := range targets {
 		go func() {
-			<-sigChan
-			printStats()
-			os.Exit(0)
-		}()
-		defer printStats()
-		for {
-			start := time.Now()
-			conn, err := net.Dial("tcp", addr)
-			t := time.Since(start)
-			if err != nil {
-				fmt.Printf("Unexpected error: %s\n", err)
-			} else {
-				conn.Close()
-				fmt.Printf("Connected %s : time=%s\n", addr, t)
-				success += 1
-				sum += t
-				if min == 0 || t < min {
-					min = t
+			defer wg.Done()
+			infinite := n <= 0
+			for i := 1; ; i++ {
+				onResult(t, i, t.probe(i))
+				if infinite || i < n {
+					time.Sleep(interval)
+				} else {
+					return
 				}
-				if t > max {
-					max = t
-				}
-			}
-			total += 1
-			i++
-			if infinite || i < n {
-				time.Sleep(interval)
-			} else {
-				return nil
 			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func formatTcpingTable(targets []*tcpingTarget, clearLine bool) string {
+	var clr string
+	if clearLine {
+		clr = "\033[2K"
+	}
+	width, addrWidth := len("Target"), len("Address")
+	for _, t := range targets {
+		t.mu.Lock()
+		width = max(width, len(t.name))
+		addrWidth = max(addrWidth, len(t.addr))
+		t.mu.Unlock()
+	}
+	buf := &strings.Builder{}
+	fmt.Fprintf(buf, "%s%-*s  %-*s  %5s  %6s  %-10s  %-10s  %-10s  %-10s\n", clr, width,
+		"Target", addrWidth, "Address", "Sent", "Loss", "Last", "Min", "Avg", "Max")
+	for _, t := range targets {
+		t.mu.Lock()
+		last := "-"
+		if t.lastErr != nil {
+			last = "fail"
+		} else if t.stats.total > 0 {
+			last = roundDuration(t.last).String()
 		}
-	},
+		fmt.Fprintf(buf, "%s%-*s  %-*s  %5d  %5.1f%%  %-10s  %-10s  %-10s  %-10s\n", clr, width,
+			t.name, addrWidth, t.addr, t.stats.total, t.stats.loss(), last,
+			roundDuration(t.stats.min), roundDuration(t.stats.avg()), roundDuration(t.stats.max))
+		t.mu.Unlock()
+	}
+	return buf.String()
+}
+
+// roundDuration keeps durations short enough for table columns
+func roundDuration(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	default:
+		return d.Round(time.Microsecond / 10)
+	}
 }
 
 func init() {
 	tcpingCmd.Flags().DurationP("interval", "i", time.Second, "time between sending each packet, minimum 400ms")
 	tcpingCmd.Flags().IntP("count", "c", 3, "ping times, nonpositive number means infinity")
+	tcpingCmd.Flags().StringP("file", "f", "", "read targets from file, one per line")
+	tcpingCmd.Flags().StringP("proxy", "p", "", "comma separated proxy chain, eg. socks5h://127.0.0.1:1080")
+	tcpingCmd.Flags().Bool("tls", false, "also time the tls handshake")
+	tcpingCmd.Flags().Bool("http", false, "also time the first byte of a GET request, tls is enabled for https url")
+	tcpingCmd.Flags().BoolP("insecure", "k", false, "skip verification of the server certificate")
+	tcpingCmd.Flags().DurationP("timeout", "t", 6*time.Second, "timeout of every probe")
+	tcpingCmd.Flags().StringP("source", "S", "", "source ip or interface name to bind")
+	tcpingCmd.Flags().BoolP("ipv4", "4", false, "use ipv4 only")
+	tcpingCmd.Flags().BoolP("ipv6", "6", false, "use ipv6 only")
+	tcpingCmd.Flags().Bool("resolve-every", false, "resolve the name before every probe instead of once")
+	tcpingCmd.Flags().StringP("output", "o", "", "machine-readable output, json or csv, one record per probe plus a summary per target")
 	rootCmd.AddCommand(tcpingCmd)
 }
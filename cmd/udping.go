@@ -1,14 +1,13 @@
 package cmd
 
 import (
+	"awake/pkg"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 	"net/url"
-	"os"
-	"os/signal"
-	"syscall"
+	"sync"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -17,12 +16,21 @@ import (
 var udpingCmd = &cobra.Command{
 	Use:   "udping",
 	Short: "Udping",
-	Args:  cobra.ExactArgs(1),
+	Long: "Udping, by default sends probe packets with sequence numbers, which are reflected with server timestamps by `awake echo --udp`,\n" +
+		"plain udp echo servers also work but can not tell the server processing time and one-way loss.\n" +
+		"With --string or --hex, the payload is sent as is and any reply is accepted.\n" +
+		"With --probe, a valid dns, ntp, snmp or stun request is sent and the decoded response is printed.",
+	Example: "  awake udping 127.0.0.1:8080\n  awake udping 1.1.1.1 --probe dns --name example.com\n" +
+		"  awake udping pool.ntp.org --probe ntp\n  awake udping stun.l.google.com:19302 --probe stun",
+	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		n, _ := cmd.Flags().GetInt("count")
 		s, _ := cmd.Flags().GetString("string")
 		interval, _ := cmd.Flags().GetDuration("interval")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
 		isHex, _ := cmd.Flags().GetBool("hex")
+		probe, _ := cmd.Flags().GetString("probe")
+		name, _ := cmd.Flags().GetString("name")
 		var data []byte
 		if isHex {
 			b, err := hex.DecodeString(s)
@@ -36,6 +44,9 @@ var udpingCmd = &cobra.Command{
 		if interval < time.Millisecond*250 {
 			return errors.New("interval too small, minimum 250ms")
 		}
+		if timeout <= 0 {
+			return errors.New("timeout must be positive")
+		}
 		if u, err := url.Parse(args[0]); err == nil {
 			host, port := u.Hostname(), u.Port()
 			if port == "" {
@@ -49,77 +60,261 @@ var udpingCmd = &cobra.Command{
 				args[0] = net.JoinHostPort(host, port)
 			}
 		}
+		var query pkg.UDPQuery
+		if probe != "" {
+			if cmd.Flags().Changed("string") || isHex {
+				return errors.New("--probe can not be used with --string or --hex")
+			}
+			q, err := pkg.NewUDPQuery(probe, name)
+			if err != nil {
+				return err
+			}
+			query = q
+			if _, _, err := net.SplitHostPort(args[0]); err != nil {
+				args[0] = net.JoinHostPort(args[0], pkg.UDPQueryPort(probe))
+			}
+		} else if cmd.Flags().Changed("string") || isHex {
+			query = &rawQuery{data: data}
+		}
 		udpAddr, err := net.ResolveUDPAddr("udp", args[0])
 		if err != nil {
 			return err
 		}
 		addr := udpAddr.String()
+		// one socket for the whole run, so that replies of earlier probes can still be recognised
+		conn, err := net.DialUDP("udp", nil, udpAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
 		fmt.Printf("Udpinging %s (%s) :\n", args[0], addr)
-		buf := make([]byte, 1024)
-		infinite := n <= 0
-		i := 0
-		var total, success int64
-		var min, max, sum time.Duration
-		printStats := func() {
-			var avg time.Duration
-			if success != 0 {
-				avg = sum / time.Duration(success)
+		if query != nil {
+			return udpingQuery(conn, query, n, interval, timeout)
+		}
+		return udpingProbe(conn, n, interval, timeout)
+	},
+}
+
+// rawQuery sends data as is and accepts any reply
+type rawQuery struct {
+	data []byte
+}
+
+func (q *rawQuery) Request() []byte {
+	return q.data
+}
+
+func (q *rawQuery) Parse(b []byte) (string, error) {
+	return fmt.Sprintf("content(%d)=%s", len(b), string(b)), nil
+}
+
+// udpingQuery sends a request and waits for a valid reply before the next probe
+func udpingQuery(conn *net.UDPConn, query pkg.UDPQuery, n int, interval, timeout time.Duration) error {
+	addr := conn.RemoteAddr().String()
+	buf := make([]byte, 65535)
+	var stats pingStats
+	printStats := func() {
+		fmt.Printf("\n%s\n", &stats)
+	}
+	onInterrupt(printStats)
+	defer printStats()
+	infinite := n <= 0
+	for i := 1; ; i++ {
+		start := time.Now()
+		_, err := conn.Write(query.Request())
+		if err == nil {
+			err = conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		for err == nil {
+			readN := 0
+			readN, err = conn.Read(buf)
+			if err != nil {
+				break
+			}
+			t := time.Since(start)
+			answer, parseErr := query.Parse(buf[:readN])
+			if parseErr != nil {
+				// maybe a late reply of an earlier request, keep waiting until timeout
+				fmt.Printf("Invalid reply from %s : %s\n", addr, parseErr)
+				continue
 			}
-			fmt.Printf("\nTotal = %d, Success = %d, Fail = %d, Pass Percentage = %.1f%%\nMin = %v, Max = %v, Avg = %v\n",
-				total, success, total-success, float64(success)/float64(total)*100, min, max, avg)
-		}
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGINT)
-		go func() {
-			<-sigChan
-			printStats()
-			os.Exit(0)
-		}()
-		defer printStats()
+			fmt.Printf("Reply from %s : time=%s  %s\n", addr, t, answer)
+			stats.add(t, true)
+			break
+		}
+		if err != nil {
+			stats.add(0, false)
+			fmt.Printf("Unexpected error: %s\n", err)
+		}
+		if infinite || i < n {
+			time.Sleep(interval)
+		} else {
+			return nil
+		}
+	}
+}
+
+// udpingSession tracks probes sent on one socket
+type udpingSession struct {
+	mu      sync.Mutex
+	pending sync.WaitGroup
+	// sent records the send time of every probe
+	sent    map[uint32]time.Time
+	replied map[uint32]bool
+	expired map[uint32]bool
+	highest uint32
+
+	stats pingStats
+	// netStats excludes the server processing time, only for replies with server timestamps
+	netStats  pingStats
+	reorder   int64
+	duplicate int64
+	late      int64
+	// serverReceived is the largest count of received probes reported by the server
+	serverReceived uint32
+}
+
+func (s *udpingSession) send(conn *net.UDPConn, seq uint32, timeout time.Duration) error {
+	now := time.Now()
+	s.mu.Lock()
+	s.sent[seq] = now
+	s.pending.Add(1)
+	s.mu.Unlock()
+	probe := &pkg.UDPProbe{Seq: seq, ClientSend: now.UnixNano()}
+	_, err := conn.Write(probe.Encode())
+	time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.replied[seq] {
+			return
+		}
+		s.expired[seq] = true
+		s.stats.add(0, false)
+		s.pending.Done()
+		fmt.Printf("Request timeout for seq=%d\n", seq)
+	})
+	return err
+}
+
+func (s *udpingSession) receive(addr string, probe *pkg.UDPProbe, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq := probe.Seq
+	sentAt, ok := s.sent[seq]
+	if !ok {
+		return
+	}
+	rtt := now.Sub(sentAt)
+	if probe.Reply && probe.Received > s.serverReceived {
+		s.serverReceived = probe.Received
+	}
+	if s.replied[seq] {
+		s.duplicate++
+		fmt.Printf("Duplicate reply from %s : seq=%d\n", addr, seq)
+		return
+	}
+	s.replied[seq] = true
+	if s.expired[seq] {
+		s.late++
+		fmt.Printf("Late reply from %s : seq=%d time=%s\n", addr, seq, rtt)
+		return
+	}
+	s.pending.Done()
+	s.stats.add(rtt, true)
+	var extra string
+	if seq < s.highest {
+		s.reorder++
+		extra = " (reordered)"
+	}
+	s.highest = max(s.highest, seq)
+	if server := probe.ServerTime(); server > 0 {
+		s.netStats.add(rtt-server, true)
+		fmt.Printf("Reply from %s : seq=%d time=%s net=%s server=%s%s\n", addr, seq, rtt, rtt-server, server, extra)
+	} else {
+		fmt.Printf("Reply from %s : seq=%d time=%s%s\n", addr, seq, rtt, extra)
+	}
+}
+
+func (s *udpingSession) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	// probes still waiting for replies are counted as lost
+	outstanding := int64(len(s.sent)) - stats.total
+	for range outstanding {
+		stats.add(0, false)
+	}
+	str := fmt.Sprintf("%s\nReorder = %d, Duplicate = %d, Late = %d", &stats, s.reorder, s.duplicate, s.late)
+	if s.netStats.success > 0 {
+		str += fmt.Sprintf("\nExcluding server time: Min = %v, Max = %v, Avg = %v", s.netStats.min, s.netStats.max, s.netStats.avg())
+	}
+	if s.serverReceived > 0 {
+		sent := int64(len(s.sent))
+		received := int64(s.serverReceived)
+		forward := max(sent-received, 0)
+		back := max(received-s.stats.success-s.late, 0)
+		str += fmt.Sprintf("\nForward Loss = %d (%.1f%%), Return Loss = %d (%.1f%%)",
+			forward, float64(forward)/float64(sent)*100, back, float64(back)/float64(max(received, 1))*100)
+	}
+	return str
+}
+
+// udpingProbe sends probe packets without waiting for replies, so that reordering, duplicates and late replies can be told from loss
+func udpingProbe(conn *net.UDPConn, n int, interval, timeout time.Duration) error {
+	addr := conn.RemoteAddr().String()
+	s := &udpingSession{
+		sent:    make(map[uint32]time.Time),
+		replied: make(map[uint32]bool),
+		expired: make(map[uint32]bool),
+	}
+	printStats := func() {
+		fmt.Printf("\n%s\n", s)
+	}
+	onInterrupt(printStats)
+	defer printStats()
+	go func() {
+		buf := make([]byte, 65535)
 		for {
-			start := time.Now()
-			conn, err := net.Dial("udp", addr)
-			if err == nil {
-				_, err = conn.Write(data)
-				if err == nil {
-					err = conn.SetReadDeadline(time.Now().Add(time.Second * 6))
-					if err == nil {
-						readN := 0
-						readN, err = conn.Read(buf)
-						if err == nil {
-							t := time.Since(start)
-							conn.Close()
-							fmt.Printf("Reply from %s : time=%s  content(%d)=%s\n", addr, t, readN, string(buf[:readN]))
-							success += 1
-							sum += t
-							if min == 0 || t < min {
-								min = t
-							}
-							if t > max {
-								max = t
-							}
-						}
-					}
+			readN, err := conn.Read(buf)
+			now := time.Now()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
 				}
+				// eg. ICMP port unreachable, the probe will time out
+				logger.Debugln(err)
+				continue
 			}
-			total += 1
+			probe, err := pkg.DecodeUDPProbe(buf[:readN])
 			if err != nil {
-				fmt.Printf("Unexpected error: %s\n", err)
-			}
-			i++
-			if infinite || i < n {
-				time.Sleep(interval)
-			} else {
-				return nil
+				fmt.Printf("Unexpected reply from %s : %d bytes\n", addr, readN)
+				continue
 			}
+			s.receive(addr, probe, now)
 		}
-	},
+	}()
+	infinite := n <= 0
+	for i := 1; ; i++ {
+		if err := s.send(conn, uint32(i), timeout); err != nil {
+			fmt.Printf("Unexpected error: %s\n", err)
+		}
+		if infinite || i < n {
+			time.Sleep(interval)
+		} else {
+			break
+		}
+	}
+	s.pending.Wait()
+	return nil
 }
 
 func init() {
-	udpingCmd.Flags().StringP("string", "s", "ping", "the string to be sent")
+	udpingCmd.Flags().StringP("string", "s", "ping", "the string to be sent instead of probe packets")
 	udpingCmd.Flags().Bool("hex", false, "input as hexadecimal string and decode it")
+	udpingCmd.Flags().String("probe", "", "send a valid request of protocol dns, ntp, snmp or stun, default port is used if not specified")
+	udpingCmd.Flags().String("name", "example.com", "the domain name to query with --probe dns")
 	udpingCmd.Flags().DurationP("interval", "i", time.Second, "time between sending each packet, minimum 400ms")
+	udpingCmd.Flags().DurationP("timeout", "t", 6*time.Second, "time to wait for a reply")
 	udpingCmd.Flags().IntP("count", "c", 3, "ping times, nonpositive number means infinity")
 	rootCmd.AddCommand(udpingCmd)
 }
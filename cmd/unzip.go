@@ -2,7 +2,10 @@ package cmd
 
 import (
 	"awake/pkg"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"os"
 	"path"
@@ -10,7 +13,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/klauspost/compress/flate"
 	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/zstd"
 	"github.com/spf13/cobra"
 )
 
@@ -37,18 +42,31 @@ var unzipCmd = &cobra.Command{
 			logger.Fatalln(err)
 		}
 		defer zipReader.Close()
+		zipReader.RegisterDecompressor(zstd.ZipMethodWinZip, zstd.ZipDecompressor())
 
 		if list {
 			for _, f := range zipReader.File {
-				fmt.Printf("%s\t%s\t%s\t%s\n",
+				var encryption string
+				if f.Flags&0x1 != 0 {
+					encryption = "\t[zipcrypto]"
+					if f.Method == pkg.WinZipAESMethod {
+						encryption = "\t[aes]"
+					}
+				}
+				fmt.Printf("%s\t%s\t%s\t%s%s\n",
 					f.Mode(),
 					pkg.FormatSize(f.UncompressedSize64, concat),
 					f.Modified.Format("2006-01-02 15:04:05"),
 					f.Name,
+					encryption,
 				)
 			}
 			return
 		}
+		password, err := readZipPassword(cmd)
+		if err != nil {
+			logger.Fatalln(err)
+		}
 		root, _ := cmd.Flags().GetString("root")
 		all, _ := cmd.Flags().GetBool("all")
 		overwrite, _ := cmd.Flags().GetBool("overwrite")
@@ -104,9 +122,9 @@ var unzipCmd = &cobra.Command{
 					}
 				}
 			} else {
-				fr, err := f.Open()
+				fr, err := openZipFile(f, password)
 				if err != nil {
-					logger.Fatalln(err)
+					logger.Fatalln(p, err)
 				}
 				fw, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode())
 				if err != nil {
@@ -126,11 +144,80 @@ var unzipCmd = &cobra.Command{
 	},
 }
 
+// openZipFile opens f, decrypting it with password if it's encrypted
+func openZipFile(f *zip.File, password string) (io.ReadCloser, error) {
+	if f.Flags&0x1 == 0 {
+		return f.Open()
+	}
+	if password == "" {
+		return nil, errors.New("encrypted, use --password or --password-file")
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	method := f.Method
+	checkCRC := true
+	var r io.Reader
+	if f.Method == pkg.WinZipAESMethod {
+		realMethod, strength, version, ok := pkg.ParseWinZipAESExtra(f.Extra)
+		if !ok {
+			return nil, errors.New("missing aes extra field")
+		}
+		method = realMethod
+		// AE-2 has no crc, the authentication code is checked instead
+		checkCRC = version == 1
+		r, err = pkg.NewWinZipAESReader(raw, int64(f.CompressedSize64), strength, password)
+	} else {
+		check := byte(f.CRC32 >> 24)
+		if f.Flags&0x8 != 0 {
+			check = byte(f.ModifiedTime >> 8)
+		}
+		r, err = pkg.NewZipCryptoReader(raw, password, check)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rc io.ReadCloser
+	switch method {
+	case zip.Store:
+		rc = io.NopCloser(r)
+	case zip.Deflate:
+		rc = flate.NewReader(r)
+	case zstd.ZipMethodWinZip:
+		rc = zstd.ZipDecompressor()(r)
+	default:
+		return nil, fmt.Errorf("unsupported compression method %d", method)
+	}
+	if checkCRC {
+		rc = &crcReader{ReadCloser: rc, hash: crc32.NewIEEE(), want: f.CRC32}
+	}
+	return rc, nil
+}
+
+// crcReader checks the crc at EOF, f.Open does so but encrypted files are read raw
+type crcReader struct {
+	io.ReadCloser
+	hash hash.Hash32
+	want uint32
+}
+
+func (r *crcReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && r.hash.Sum32() != r.want {
+		return n, errors.New("checksum mismatch, the password may be wrong")
+	}
+	return n, err
+}
+
 func init() {
 	unzipCmd.Flags().Bool("overwrite", false, "overwrite output file")
 	unzipCmd.Flags().BoolP("list", "l", false, "list files of the specified zip archive")
 	unzipCmd.Flags().Bool("all", false, "unarchive all files, the regexp to exclude files will be ignored")
 	unzipCmd.Flags().String("exclude", `node_modules|__pycache__|venv|\.git`, "specify regexp to exclude files, first match the basename, then match the archive path")
+	unzipCmd.Flags().String("password", "", "password of encrypted files")
+	unzipCmd.Flags().String("password-file", "", "read the password from the first line of the file")
 	unzipCmd.Flags().String("root", "./", "the root directory to unarchive")
 	rootCmd.AddCommand(unzipCmd)
 }
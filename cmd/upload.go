@@ -82,7 +82,7 @@ var uploadCmd = &cobra.Command{
 func init() {
 	uploadCmd.Flags().IntP("concurrency", "c", 6, "maximum concurrency")
 	uploadCmd.Flags().Bool("glob", false, "enable global syntax")
-	uploadCmd.Flags().StringP("proxy", "p", "", "proxy url")
+	uploadCmd.Flags().StringP("proxy", "p", "", "comma separated proxy chain, default from ALL_PROXY, HTTPS_PROXY, HTTP_PROXY")
 	uploadCmd.Flags().DurationP("duration", "d", time.Hour*12, "storage duration, 0 for permanent")
 	rootCmd.AddCommand(uploadCmd)
 }
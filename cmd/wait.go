@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"awake/pkg"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// waitAttemptTimeout bounds a single attempt, the overall deadline may cut it shorter
+const waitAttemptTimeout = 5 * time.Second
+
+// waitTarget is ready once check returns nil
+type waitTarget struct {
+	name  string
+	check func(timeout time.Duration) error
+}
+
+// newWaitDialTarget waits for host:port to accept connections, or for an http(s) url to return one of statuses
+func newWaitDialTarget(name string, statuses []int, opts tcpingOptions) (*waitTarget, error) {
+	if u, err := url.Parse(name); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		opts.http = true
+	}
+	t, err := newTcpingTarget(name, &opts)
+	if t == nil {
+		return nil, err
+	}
+	// a failed resolution is retried, eg. the container of the name is not created yet
+	check := func(timeout time.Duration) error {
+		if opts.proxy == "" {
+			if err := t.resolve(); err != nil {
+				return err
+			}
+		}
+		t.opts.timeout = timeout
+		r := &tcpingResult{}
+		if err := t.dial(t.addr, r); err != nil {
+			return err
+		}
+		if opts.http && !slices.Contains(statuses, r.status) {
+			return fmt.Errorf("unexpected status %d", r.status)
+		}
+		return nil
+	}
+	return &waitTarget{name: name, check: check}, nil
+}
+
+// newWaitFreeTarget waits until nothing listens on the local ports
+func newWaitFreeTarget(ports []int, kind string) *waitTarget {
+	name := "free " + kind + " ports " + formatPortRanges(ports)
+	check := func(time.Duration) error {
+		processes, err := pkg.ListPortProcesses(&pkg.PortFilter{Ports: ports, Kind: kind, Listen: true})
+		if err != nil {
+			return err
+		}
+		if len(processes) == 0 {
+			return nil
+		}
+		var held []string
+		for _, p := range processes {
+			held = append(held, fmt.Sprintf("%s by %d %s", p.Laddr, p.PID, p.Name))
+		}
+		return fmt.Errorf("still held: %s", strings.Join(held, ", "))
+	}
+	return &waitTarget{name: name, check: check}
+}
+
+// waitAll checks every target each interval until it's ready, and returns the targets not ready before timeout
+// with their last errors, 0 timeout means no limit
+func waitAll(targets []*waitTarget, interval, timeout time.Duration) map[*waitTarget]error {
+	start := time.Now()
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		notReady = make(map[*waitTarget]error)
+	)
+	for _, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				attemptTimeout := waitAttemptTimeout
+				if timeout > 0 {
+					attemptTimeout = min(attemptTimeout, timeout-time.Since(start))
+				}
+				err := t.check(attemptTimeout)
+				if err == nil {
+					logger.Infof("%s is ready after %v", t.name, roundDuration(time.Since(start)))
+					return
+				}
+				logger.Debugf("%s is not ready: %v", t.name, err)
+				if timeout > 0 && time.Since(start)+interval >= timeout {
+					mu.Lock()
+					notReady[t] = err
+					mu.Unlock()
+					return
+				}
+				time.Sleep(interval)
+			}
+		}()
+	}
+	wg.Wait()
+	return notReady
+}
+
+var waitCmd = &cobra.Command{
+	Use:   "wait",
+	Short: "Wait for ports and urls to be ready or local ports to be free",
+	Example: "  awake wait db:5432 redis:6379 -t 60s\n  awake wait http://127.0.0.1:8080/health --status 200\n" +
+		"  awake wait --free 8080 3000-3010",
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		interval, _ := cmd.Flags().GetDuration("interval")
+		free, _ := cmd.Flags().GetBool("free")
+		kind, _ := cmd.Flags().GetString("kind")
+		status, _ := cmd.Flags().GetString("status")
+		opts := tcpingOptions{network: "tcp"}
+		opts.proxy, _ = cmd.Flags().GetString("proxy")
+		opts.insecure, _ = cmd.Flags().GetBool("insecure")
+		if interval <= 0 {
+			logger.Fatalln("interval must be positive")
+		}
+		var targets []*waitTarget
+		if free {
+			filter, err := pkg.NewPortFilter(kind, args)
+			if err != nil {
+				logger.Fatalln(err)
+			}
+			slices.Sort(filter.Ports)
+			targets = append(targets, newWaitFreeTarget(filter.Ports, kind))
+		} else {
+			statuses, err := pkg.ParsePortRanges(status)
+			if err == nil && len(statuses) == 0 {
+				err = errors.New("no status")
+			}
+			if err != nil {
+				logger.Fatalf("invalid status %s: %v", status, err)
+			}
+			for _, arg := range args {
+				t, err := newWaitDialTarget(arg, statuses, opts)
+				if err != nil {
+					logger.Fatalf("%s is not host:port or url: %v", arg, err)
+				}
+				targets = append(targets, t)
+			}
+		}
+		notReady := waitAll(targets, interval, timeout)
+		if len(notReady) == 0 {
+			return
+		}
+		for _, t := range targets {
+			if err, ok := notReady[t]; ok {
+				logger.Errorf("%s is not ready after %v: %v", t.name, timeout, err)
+			}
+		}
+		os.Exit(1)
+	},
+}
+
+func init() {
+	waitCmd.Flags().DurationP("timeout", "t", 30*time.Second, "give up and exit with 1 after the duration, 0 means no limit")
+	waitCmd.Flags().DurationP("interval", "i", time.Second, "time between checks")
+	waitCmd.Flags().String("status", "200-399", "expected http statuses of urls, eg. 200,204 or 200-299")
+	waitCmd.Flags().StringP("proxy", "p", "", "comma separated proxy chain, eg. socks5h://127.0.0.1:1080")
+	waitCmd.Flags().BoolP("insecure", "k", false, "skip verification of the server certificate")
+	waitCmd.Flags().Bool("free", false, "wait until nothing listens on the local ports given as arguments")
+	waitCmd.Flags().String("kind", "tcp", "kind of --free ports, one of tcp, tcp4, tcp6, udp, udp4, udp6, inet, inet4, inet6")
+	rootCmd.AddCommand(waitCmd)
+}
@@ -2,12 +2,14 @@ package cmd
 
 import (
 	"awake/pkg"
+	"errors"
 	"fmt"
-	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,7 +20,7 @@ import (
 var zipCmd = &cobra.Command{
 	Use:   "zip",
 	Short: "Archive files with zip",
-	Long:  "Archive files with zip, set log level to WARN to get better compression performance",
+	Long:  "Archive files with zip, files are compressed concurrently and written in a deterministic order",
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 
@@ -26,11 +28,66 @@ var zipCmd = &cobra.Command{
 		output, _ := cmd.Flags().GetString("output")
 		all, _ := cmd.Flags().GetBool("all")
 		overwrite, _ := cmd.Flags().GetBool("overwrite")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		gitignore, _ := cmd.Flags().GetBool("gitignore")
+		includeGlobs, _ := cmd.Flags().GetStringArray("include")
+		var includes []*pkg.GlobPattern
+		for _, glob := range includeGlobs {
+			pattern, err := pkg.ParseGlobPattern(glob)
+			if err != nil {
+				logger.Fatalf("invalid include pattern %s: %v", glob, err)
+			}
+			if pattern != nil {
+				includes = append(includes, pattern)
+			}
+		}
+		jobs, _ := cmd.Flags().GetInt("jobs")
+		if jobs <= 0 {
+			logger.Fatalln("jobs must be positive")
+		}
 		rule, _ := cmd.Flags().GetString("exclude")
 		excludeRegexp, err := regexp.Compile(rule)
 		if err != nil {
 			logger.Fatalln(err)
 		}
+		compressionLevel, _ := cmd.Flags().GetInt("compression-level")
+		methodName, _ := cmd.Flags().GetString("method")
+		storeExts, _ := cmd.Flags().GetStringSlice("store")
+		if compressionLevel < -1 || compressionLevel > 9 {
+			logger.Fatalln("compression level must be -1 (default) or 0-9")
+		}
+		storeAll := compressionLevel == 0 || methodName == "store"
+		var (
+			method     uint16
+			compressor zip.Compressor
+		)
+		if methodName != "store" {
+			if method, compressor, err = newZipCompressor(methodName, compressionLevel); err != nil {
+				logger.Fatalln(err)
+			}
+		}
+		opts := &zipWriteOptions{jobs: jobs, compressor: compressor}
+		if opts.password, err = readZipPassword(cmd); err != nil {
+			logger.Fatalln(err)
+		}
+		switch encryption, _ := cmd.Flags().GetString("encryption"); encryption {
+		case "aes":
+		case "zipcrypto":
+			opts.zipCrypto = true
+			if opts.password != "" {
+				logger.Warnln("ZipCrypto is easily broken, use it only for unzip tools without AES support")
+			}
+		default:
+			logger.Fatalln("encryption must be aes or zipcrypto")
+		}
+		storeSet := make(map[string]struct{})
+		for _, ext := range storeExts {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			if ext != "" && !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			storeSet[ext] = struct{}{}
+		}
 		if all {
 			logger.Debugln("archive all files except output file, the regexp to exclude was ignored")
 		} else {
@@ -85,19 +142,22 @@ var zipCmd = &cobra.Command{
 			}
 		} else if info.IsDir() {
 			logger.Fatalln(output, "is a directory")
-		} else if overwrite {
+		} else if !dryRun {
+			if !overwrite {
+				logger.Fatalln(output, "already exists, you should use --overwrite")
+			}
 			logger.Warnln("overwrite output file")
-		} else {
-			logger.Fatalln(output, "already exists, you should use --overwrite")
-		}
-		f, err := os.Create(output)
-		if err != nil {
-			logger.Fatalln(err)
 		}
 		var fatalErr error
-		zipWriter := zip.NewWriter(f)
 		start := time.Now()
+		// walk in a fixed order, so the same files always make the same archive
+		roots := make([]string, 0, len(set))
 		for p := range set {
+			roots = append(roots, p)
+		}
+		sort.Strings(roots)
+		var entries []*zipEntry
+		for _, p := range roots {
 			root := filepath.Base(p)
 			// if p is "..", then root is ".." and archive path starts with "..", so we need get real name of ".."
 			if root == ".." {
@@ -108,7 +168,10 @@ var zipCmd = &cobra.Command{
 					root = filepath.Base(filepath.Dir(d))
 				}
 			}
-			// logger.Fatalln(root)
+			var ignore *pkg.GitIgnore
+			if gitignore {
+				ignore = pkg.NewGitIgnore(p)
+			}
 			fatalErr = filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
 				if err != nil {
 					return err
@@ -141,8 +204,30 @@ var zipCmd = &cobra.Command{
 					}
 					return nil
 				}
-				if pkg.GetLogLevel() <= pkg.LINFO {
-					fmt.Println(path, "=>", archivePath)
+				if ignore != nil {
+					ignored, err := ignore.Ignored(path, info.IsDir())
+					if err != nil {
+						return err
+					}
+					if ignored {
+						if pkg.GetLogLevel() <= pkg.LDEBUG {
+							fmt.Println("skip", logger.Yellow(path), "because it's ignored by .gitignore or .ignore")
+						}
+						if info.IsDir() {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+				}
+				if len(includes) > 0 && !info.IsDir() {
+					includePath := filepath.ToSlash(relPath)
+					if includePath == "." {
+						// p is a file
+						includePath = info.Name()
+					}
+					if !pkg.MatchGlobPatterns(includes, includePath, false) {
+						return nil
+					}
 				}
 				header, err := zip.FileInfoHeader(info)
 				if err != nil {
@@ -152,26 +237,48 @@ var zipCmd = &cobra.Command{
 				if info.IsDir() {
 					header.Name += "/" // required - strangely no mention of this in zip spec? but is in godoc...
 					header.Method = zip.Store
-					_, err = zipWriter.CreateHeader(header)
-					return err
-				}
-				header.Method = zip.Deflate
-				writer, err := zipWriter.CreateHeader(header)
-				if err != nil {
-					return err
-				}
-				file, err := os.Open(path)
-				if err != nil {
-					return err
+					header.UncompressedSize64 = 0
+				} else if _, ok := storeSet[strings.ToLower(filepath.Ext(path))]; ok || storeAll {
+					header.Method = zip.Store
+				} else {
+					header.Method = method
 				}
-				defer file.Close()
-				_, err = io.Copy(writer, file)
-				return err
+				entries = append(entries, newZipEntry(path, header))
+				return nil
 			})
 			if fatalErr != nil {
 				break
 			}
 		}
+		if fatalErr != nil {
+			logger.Fatalln(fatalErr)
+		}
+		if len(includes) > 0 {
+			entries = dropEmptyZipDirs(entries)
+		}
+		if dryRun {
+			var size int64
+			files := 0
+			for _, e := range entries {
+				fmt.Println(e.header.Name)
+				if !e.header.FileInfo().IsDir() {
+					files++
+					size += int64(e.header.UncompressedSize64)
+				}
+			}
+			logger.Warnf("dry run, %d files %s would be archived to %s", files, pkg.FormatSize(size), output)
+			return
+		}
+		f, err := os.Create(output)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		zipWriter := zip.NewWriter(f)
+		fatalErr = writeZipEntries(zipWriter, entries, opts, func(e *zipEntry) {
+			if pkg.GetLogLevel() <= pkg.LINFO {
+				fmt.Println(e.path, "=>", e.header.Name)
+			}
+		})
 		zipWriter.Close()
 		end := time.Now()
 		defer f.Close()
@@ -192,9 +299,61 @@ var zipCmd = &cobra.Command{
 	},
 }
 
+// dropEmptyZipDirs removes directories without any file below, eg. all files were filtered out by --include
+func dropEmptyZipDirs(entries []*zipEntry) []*zipEntry {
+	used := make(map[string]bool)
+	for _, e := range entries {
+		if e.header.FileInfo().IsDir() {
+			continue
+		}
+		for dir := path.Dir(e.header.Name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			used[dir+"/"] = true
+		}
+	}
+	result := entries[:0]
+	for _, e := range entries {
+		if !e.header.FileInfo().IsDir() || used[e.header.Name] {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// readZipPassword returns the password of --password or the first line of --password-file, empty if neither
+func readZipPassword(cmd *cobra.Command) (string, error) {
+	password, _ := cmd.Flags().GetString("password")
+	file, _ := cmd.Flags().GetString("password-file")
+	if file == "" {
+		return password, nil
+	}
+	if password != "" {
+		return "", errors.New("--password and --password-file are mutually exclusive")
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	password, _, _ = strings.Cut(string(b), "\n")
+	password = strings.TrimSuffix(password, "\r")
+	if password == "" {
+		return "", fmt.Errorf("empty password in %s", file)
+	}
+	return password, nil
+}
+
 func init() {
 	zipCmd.Flags().Bool("overwrite", false, "overwrite output file")
 	zipCmd.Flags().StringP("output", "o", "", "output file")
+	zipCmd.Flags().IntP("jobs", "j", runtime.NumCPU(), "number of files compressed concurrently")
+	zipCmd.Flags().IntP("compression-level", "L", -1, "compression level 0-9, 0 stores files, -1 is 5 for deflate and 3 for zstd")
+	zipCmd.Flags().String("method", "deflate", "compression method, deflate, zstd or store, zstd needs a recent unzip, eg. 7-Zip or WinZip")
+	zipCmd.Flags().StringSlice("store", zipStoreExts, "extensions stored without compression, empty to compress all")
+	zipCmd.Flags().String("password", "", "encrypt files with the password, visible to other users in the process list, prefer --password-file")
+	zipCmd.Flags().String("password-file", "", "read the password from the first line of the file")
+	zipCmd.Flags().String("encryption", "aes", "encryption of --password, aes for WinZip AES-256, or zipcrypto for old unzip tools")
+	zipCmd.Flags().Bool("gitignore", false, "skip files ignored by .gitignore and .ignore files in the archived directories")
+	zipCmd.Flags().StringArray("include", nil, "only archive files matching the gitignore style glob, relative to the archived directory, repeatable, eg. '*.go' '!*_test.go'")
+	zipCmd.Flags().Bool("dry-run", false, "list what would be archived without writing the output file")
 	zipCmd.Flags().Bool("glob", false, "use glob pattern")
 	zipCmd.Flags().Bool("all", false, "archive all files except output file, the regexp to exclude files will be ignored")
 	zipCmd.Flags().String("exclude", `^(node_modules|__pycache__|venv|\.git)$`, "specify regexp to exclude files, first match the basename, then match the archive path")
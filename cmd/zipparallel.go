@@ -0,0 +1,336 @@
+package cmd
+
+import (
+	"awake/pkg"
+	"bytes"
+	stdflate "compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// zipSpillSize is the compressed size of an entry kept in memory, larger entries spill to a temporary file
+const zipSpillSize = 8 << 20
+
+// zipStoreExts are formats already compressed, deflating them again only burns CPU
+var zipStoreExts = []string{
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic", ".avif",
+	".mp3", ".m4a", ".aac", ".ogg", ".opus", ".flac",
+	".mp4", ".m4v", ".mkv", ".mov", ".avi", ".webm",
+	".zip", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".lz4", ".br", ".7z", ".rar",
+	".jar", ".apk", ".docx", ".xlsx", ".pptx", ".odt", ".epub", ".woff", ".woff2",
+}
+
+// newZipCompressor returns the method and the compressor of level 1-9, negative level means the default of the method
+func newZipCompressor(method string, level int) (uint16, zip.Compressor, error) {
+	switch method {
+	case "deflate":
+		if level < 0 {
+			level = flate.DefaultCompression
+		}
+		if level >= 7 {
+			// Info-ZIP unzip 6.0 rejects some streams of the higher levels of klauspost/compress
+			return zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+				return stdflate.NewWriter(w, level)
+			}, nil
+		}
+		return zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		}, nil
+	case "zstd":
+		encLevel := zstd.SpeedDefault
+		if level >= 0 {
+			encLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		// files are already compressed concurrently
+		return zstd.ZipMethodWinZip, zstd.ZipCompressor(zstd.WithEncoderLevel(encLevel), zstd.WithEncoderConcurrency(1)), nil
+	default:
+		return 0, nil, fmt.Errorf("unsupported method %s, must be deflate, zstd or store", method)
+	}
+}
+
+// zipWriteOptions controls how writeZipEntries compresses and encrypts files
+type zipWriteOptions struct {
+	jobs int
+	// compressor compresses entries of any method other than store
+	compressor zip.Compressor
+	// password encrypts every file if not empty, with AES-256 unless zipCrypto
+	password  string
+	zipCrypto bool
+}
+
+// zipEntry is a file or directory to archive, files are compressed by a worker before written in order,
+// directories and stored files without encryption are written by the writer directly
+type zipEntry struct {
+	// path is the file on disk
+	path   string
+	header *zip.FileHeader
+	done   chan struct{}
+	data   *spillBuffer
+	err    error
+}
+
+func newZipEntry(path string, header *zip.FileHeader) *zipEntry {
+	return &zipEntry{path: path, header: header, done: make(chan struct{})}
+}
+
+// direct reports whether the entry is written without a worker
+func (e *zipEntry) direct(opts *zipWriteOptions) bool {
+	return e.header.FileInfo().IsDir() || e.header.Method == zip.Store && opts.password == ""
+}
+
+// compress fills data and the sizes and crc of header, the header is ready for CreateRaw
+func (e *zipEntry) compress(opts *zipWriteOptions) {
+	defer close(e.done)
+	file, err := os.Open(e.path)
+	if err != nil {
+		e.err = err
+		return
+	}
+	defer file.Close()
+	prepareRawHeader(e.header)
+	e.data = &spillBuffer{limit: zipSpillSize}
+	comp := opts.compressor
+	if e.header.Method == zip.Store {
+		comp = func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		}
+	}
+	var (
+		w         io.Writer = e.data
+		encrypter io.Closer
+		isAES     bool
+	)
+	if opts.password != "" {
+		e.header.Flags |= 0x1
+		if opts.zipCrypto {
+			// the crc is unknown before compression, so the check byte is from the time with a data descriptor
+			e.header.Flags |= 0x8
+			w, err = pkg.NewZipCryptoWriter(e.data, opts.password, byte(e.header.ModifiedTime>>8))
+		} else {
+			var aw io.WriteCloser
+			aw, err = pkg.NewWinZipAESWriter(e.data, opts.password)
+			w, encrypter, isAES = aw, aw, true
+			e.header.Extra = append(e.header.Extra, pkg.WinZipAESExtra(e.header.Method)...)
+			e.header.Method = pkg.WinZipAESMethod
+		}
+		if err != nil {
+			e.err = err
+			return
+		}
+	}
+	fw, err := comp(w)
+	if err != nil {
+		e.err = err
+		return
+	}
+	crc := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(fw, crc), file)
+	if err == nil {
+		err = fw.Close()
+	}
+	if err == nil && encrypter != nil {
+		err = encrypter.Close()
+	}
+	if err != nil {
+		e.err = err
+		return
+	}
+	// AE-2 leaves crc 0, the authentication code covers the data
+	if !isAES {
+		e.header.CRC32 = crc.Sum32()
+	}
+	e.header.UncompressedSize64 = uint64(n)
+	e.header.CompressedSize64 = uint64(e.data.Len())
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// writeZipEntries compresses entries with jobs workers and writes them in the order of entries,
+// onWrite is called before an entry is written
+func writeZipEntries(zw *zip.Writer, entries []*zipEntry, opts *zipWriteOptions, onWrite func(e *zipEntry)) error {
+	for _, e := range entries {
+		if e.direct(opts) {
+			close(e.done)
+		}
+	}
+	// workers run ahead of the writer by at most window entries, which bounds memory and temporary files
+	window := make(chan struct{}, 2*opts.jobs)
+	quit := make(chan struct{})
+	work := make(chan *zipEntry)
+	go func() {
+		defer close(work)
+		for _, e := range entries {
+			select {
+			case window <- struct{}{}:
+			case <-quit:
+				return
+			}
+			if e.direct(opts) {
+				continue
+			}
+			select {
+			case work <- e:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for range opts.jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range work {
+				e.compress(opts)
+			}
+		}()
+	}
+	var err error
+	for _, e := range entries {
+		<-e.done
+		if err = e.err; err != nil {
+			break
+		}
+		onWrite(e)
+		if err = writeZipEntry(zw, e); err != nil {
+			break
+		}
+		<-window
+	}
+	close(quit)
+	wg.Wait()
+	// entries compressed ahead of a failure are never written
+	for _, e := range entries {
+		if e.data != nil {
+			e.data.Close()
+		}
+	}
+	return err
+}
+
+func writeZipEntry(zw *zip.Writer, e *zipEntry) error {
+	if e.header.FileInfo().IsDir() {
+		_, err := zw.CreateHeader(e.header)
+		return err
+	}
+	if e.data == nil {
+		w, err := zw.CreateHeader(e.header)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(e.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(w, file)
+		return err
+	}
+	w, err := zw.CreateRaw(e.header)
+	if err != nil || e.data == nil {
+		return err
+	}
+	_, err = e.data.WriteTo(w)
+	e.data.Close()
+	e.data = nil
+	return err
+}
+
+// prepareRawHeader sets what CreateHeader would set, CreateRaw writes the header as is
+func prepareRawHeader(fh *zip.FileHeader) {
+	for _, r := range fh.Name {
+		if r >= utf8.RuneSelf {
+			if utf8.ValidString(fh.Name) {
+				fh.Flags |= 0x800
+			}
+			break
+		}
+	}
+	fh.CreatorVersion = fh.CreatorVersion&0xff00 | 20
+	fh.ReaderVersion = 20
+	if fh.Modified.IsZero() {
+		return
+	}
+	t := fh.Modified
+	fh.ModifiedDate = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	fh.ModifiedTime = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	// extended timestamp like Info-ZIP, the msdos time has no time zone and a 2 seconds resolution
+	extra := binary.LittleEndian.AppendUint16(nil, 0x5455)
+	extra = binary.LittleEndian.AppendUint16(extra, 5)
+	extra = append(extra, 1)
+	extra = binary.LittleEndian.AppendUint32(extra, uint32(t.Unix()))
+	fh.Extra = append(fh.Extra, extra...)
+}
+
+// spillBuffer keeps up to limit bytes in memory, then moves everything to a temporary file
+type spillBuffer struct {
+	limit int
+	buf   bytes.Buffer
+	file  *os.File
+	n     int64
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && b.buf.Len()+len(p) > b.limit {
+		f, err := os.CreateTemp("", "awake-zip-*")
+		if err != nil {
+			return 0, err
+		}
+		b.file = f
+		if _, err := b.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+	var (
+		n   int
+		err error
+	)
+	if b.file != nil {
+		n, err = b.file.Write(p)
+	} else {
+		n, err = b.buf.Write(p)
+	}
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *spillBuffer) Len() int64 {
+	return b.n
+}
+
+func (b *spillBuffer) WriteTo(w io.Writer) (int64, error) {
+	if b.file == nil {
+		return b.buf.WriteTo(w)
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, b.file)
+}
+
+// Close removes the temporary file
+func (b *spillBuffer) Close() error {
+	b.buf = bytes.Buffer{}
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	err := os.Remove(b.file.Name())
+	b.file = nil
+	return err
+}
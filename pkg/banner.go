@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Banner is the identified service of an open port
+type Banner struct {
+	// Service is ssh, http, https, tls, redis, mysql, smtp, ftp or empty if unknown
+	Service string
+	// Info is the version, server header, certificate common name or the first line of the greeting
+	Info string
+}
+
+func (b *Banner) String() string {
+	switch {
+	case b.Service == "":
+		return b.Info
+	case b.Info == "":
+		return b.Service
+	default:
+		return b.Service + " " + b.Info
+	}
+}
+
+// GrabBanner reads the greeting of conn and identifies the service. If the server is silent, it is nudged
+// with an HTTP HEAD request, and then with a TLS ClientHello on a new connection from redial if HEAD gets
+// no answer or a TLS alert. serverName is used as Host header and SNI, conn is closed before returning.
+func GrabBanner(conn net.Conn, redial func() (net.Conn, error), serverName string, timeout time.Duration) *Banner {
+	defer conn.Close()
+	b, err := readGreeting(conn, timeout)
+	if len(b) > 0 {
+		return identifyBanner(b)
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		// closed by server without a word
+		return &Banner{}
+	}
+	if _, err := conn.Write(headRequest(serverName)); err != nil {
+		return &Banner{}
+	}
+	b, _ = readGreeting(conn, timeout)
+	// 0x15 is the content type of TLS alert record, some https servers answer plain http with 400 instead
+	if len(b) > 0 && b[0] != 0x15 && !bytes.Contains(b, []byte("HTTPS")) {
+		return identifyBanner(b)
+	}
+	if redial == nil {
+		return &Banner{}
+	}
+	c, err := redial()
+	if err != nil {
+		return &Banner{}
+	}
+	defer c.Close()
+	tlsConn := tls.Client(c, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return &Banner{}
+	}
+	banner := &Banner{Service: "tls"}
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		cn := certs[0].Subject.CommonName
+		if cn == "" && len(certs[0].DNSNames) > 0 {
+			cn = certs[0].DNSNames[0]
+		}
+		if cn != "" {
+			banner.Info = "cn=" + cn
+		}
+	}
+	if _, err := tlsConn.Write(headRequest(serverName)); err == nil {
+		if b, _ := readGreeting(tlsConn, timeout); bytes.HasPrefix(b, []byte("HTTP/")) {
+			banner.Service = "https"
+			if server := httpServerHeader(b); server != "" {
+				banner.Info = strings.TrimSpace(banner.Info + " " + server)
+			}
+		}
+	}
+	return banner
+}
+
+func headRequest(host string) []byte {
+	if host == "" {
+		host = "localhost"
+	}
+	return []byte("HEAD / HTTP/1.0\r\nHost: " + host + "\r\nUser-Agent: awake\r\n\r\n")
+}
+
+func readGreeting(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	return buf[:n], err
+}
+
+func httpServerHeader(b []byte) string {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+	if err != nil {
+		return ""
+	}
+	return resp.Header.Get("Server")
+}
+
+// identifyBanner labels the service by its greeting or its answer to HTTP HEAD
+func identifyBanner(b []byte) *Banner {
+	line := firstLine(b)
+	switch {
+	case bytes.HasPrefix(b, []byte("SSH-")):
+		return &Banner{Service: "ssh", Info: line}
+	case bytes.HasPrefix(b, []byte("HTTP/")):
+		if server := httpServerHeader(b); server != "" {
+			return &Banner{Service: "http", Info: server}
+		}
+		return &Banner{Service: "http", Info: line}
+	case bytes.HasPrefix(b, []byte("-ERR")) || bytes.HasPrefix(b, []byte("-NOAUTH")) ||
+		bytes.HasPrefix(b, []byte("-DENIED")) || bytes.HasPrefix(b, []byte("+PONG")):
+		return &Banner{Service: "redis", Info: line}
+	case bytes.HasPrefix(b, []byte("220")):
+		if strings.Contains(strings.ToUpper(line), "FTP") {
+			return &Banner{Service: "ftp", Info: line}
+		}
+		return &Banner{Service: "smtp", Info: line}
+	}
+	// mysql packet: length(3) sequence(1) payload, the greeting is protocol version 10 and a null terminated
+	// server version, or an error packet 0xff code(2) message if the client is not allowed
+	if len(b) > 5 && b[3] == 0 && int(b[0])|int(b[1])<<8|int(b[2])<<16 <= len(b)-4 {
+		switch b[4] {
+		case 0x0a:
+			version, _, _ := bytes.Cut(b[5:], []byte{0})
+			return &Banner{Service: "mysql", Info: printable(version)}
+		case 0xff:
+			if len(b) > 7 {
+				return &Banner{Service: "mysql", Info: printable(b[7:])}
+			}
+		}
+	}
+	return &Banner{Info: line}
+}
+
+func firstLine(b []byte) string {
+	line, _, _ := bytes.Cut(b, []byte("\n"))
+	return printable(bytes.TrimRight(line, "\r"))
+}
+
+// printable replaces non-printable characters with dots and truncates long text
+func printable(b []byte) string {
+	if len(b) > 80 {
+		b = b[:80]
+	}
+	s := bytes.Clone(b)
+	for i, c := range s {
+		if c < 0x20 || c > 0x7e {
+			s[i] = '.'
+		}
+	}
+	return string(s)
+}
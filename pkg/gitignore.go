@@ -0,0 +1,246 @@
+package pkg
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// GlobPattern is a pattern in gitignore syntax, https://git-scm.com/docs/gitignore
+type GlobPattern struct {
+	re *regexp.Regexp
+	// Negate is true for patterns starting with !
+	Negate bool
+	// DirOnly is true for patterns ending with /
+	DirOnly bool
+}
+
+// ParseGlobPattern parses a line of a gitignore file, nil for blank lines and comments
+func ParseGlobPattern(line string) (*GlobPattern, error) {
+	line = strings.TrimSuffix(line, "\r")
+	// trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	p := &GlobPattern{}
+	if strings.HasPrefix(line, "!") {
+		p.Negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") && !strings.HasSuffix(line, `\/`) {
+		p.DirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil, nil
+	}
+	// a slash at the beginning or middle anchors the pattern to the directory of the gitignore file,
+	// otherwise it matches at any level below
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	re, err := globToRegexp(line)
+	if err != nil {
+		return nil, err
+	}
+	if anchored {
+		re = "^" + re + "$"
+	} else {
+		re = "^(?:.*/)?" + re + "$"
+	}
+	p.re, err = regexp.Compile(re)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func globToRegexp(glob string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(glob); {
+		rest := glob[i:]
+		switch {
+		case i == 0 && strings.HasPrefix(rest, "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 3
+		case strings.HasPrefix(rest, "/**/"):
+			b.WriteString("/(?:.*/)?")
+			i += 4
+		case rest == "/**":
+			b.WriteString("/.*")
+			i += 3
+		case rest == "**" && i == 0:
+			b.WriteString(".*")
+			i += 2
+		case rest[0] == '*':
+			// other consecutive asterisks are regular asterisks
+			b.WriteString("[^/]*")
+			for i < len(glob) && glob[i] == '*' {
+				i++
+			}
+		case rest[0] == '?':
+			b.WriteString("[^/]")
+			i++
+		case rest[0] == '\\':
+			if len(rest) == 1 {
+				return "", errors.New("trailing backslash in pattern")
+			}
+			b.WriteString(regexp.QuoteMeta(rest[1:2]))
+			i += 2
+		case rest[0] == '[':
+			class, n := globClass(rest)
+			if n == 0 {
+				// no closing bracket, a literal [
+				b.WriteString(`\[`)
+				i++
+			} else {
+				b.WriteString(class)
+				i += n
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(rest[:1]))
+			i++
+		}
+	}
+	return b.String(), nil
+}
+
+// globClass converts a bracket expression at the start of s, n is 0 if it's not closed
+func globClass(s string) (class string, n int) {
+	var b strings.Builder
+	b.WriteString("[")
+	i := 1
+	if i < len(s) && (s[i] == '!' || s[i] == '^') {
+		b.WriteString("^")
+		i++
+	}
+	// a ] right after [ or [! is a literal
+	if i < len(s) && s[i] == ']' {
+		b.WriteString(`\]`)
+		i++
+	}
+	for ; i < len(s); i++ {
+		switch c := s[i]; c {
+		case ']':
+			b.WriteString("]")
+			return b.String(), i + 1
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteString(regexp.QuoteMeta(s[i : i+1]))
+			}
+		case '[':
+			// character classes like [:alpha:] have the same syntax in regexp
+			if end := strings.Index(s[i:], ":]"); strings.HasPrefix(s[i:], "[:") && end > 1 {
+				b.WriteString(s[i : i+end+2])
+				i += end + 1
+			} else {
+				b.WriteString(`\[`)
+			}
+		case '-':
+			b.WriteByte('-')
+		default:
+			b.WriteString(regexp.QuoteMeta(s[i : i+1]))
+		}
+	}
+	return "", 0
+}
+
+// Match reports whether the slash separated path relative to the directory of the pattern matches
+func (p *GlobPattern) Match(path string, isDir bool) bool {
+	if p.DirOnly && !isDir {
+		return false
+	}
+	return p.re.MatchString(path)
+}
+
+// MatchGlobPatterns reports whether any of patterns matches path, the last matching pattern decides,
+// so a negated pattern excludes paths an earlier one matched
+func MatchGlobPatterns(patterns []*GlobPattern, path string, isDir bool) bool {
+	matched := false
+	for _, p := range patterns {
+		if p.Match(path, isDir) {
+			matched = !p.Negate
+		}
+	}
+	return matched
+}
+
+// GitIgnore matches paths under root against the .gitignore and .ignore files of root and its subdirectories,
+// a file deeper or later overrides the patterns before
+type GitIgnore struct {
+	root  string
+	files []string
+	dirs  map[string][]*GlobPattern
+}
+
+func NewGitIgnore(root string) *GitIgnore {
+	return &GitIgnore{root: root, files: []string{".gitignore", ".ignore"}, dirs: make(map[string][]*GlobPattern)}
+}
+
+// load reads the ignore files of dir relative to root once
+func (g *GitIgnore) load(dir string) ([]*GlobPattern, error) {
+	if patterns, ok := g.dirs[dir]; ok {
+		return patterns, nil
+	}
+	var patterns []*GlobPattern
+	for _, name := range g.files {
+		f, err := os.Open(filepath.Join(g.root, filepath.FromSlash(dir), name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			p, err := ParseGlobPattern(scanner.Text())
+			if err != nil {
+				// git skips invalid patterns too
+				continue
+			}
+			if p != nil {
+				patterns = append(patterns, p)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	g.dirs[dir] = patterns
+	return patterns, nil
+}
+
+// Ignored reports whether path under root is ignored, the parents of path are not checked,
+// so a walk should skip ignored directories, a file in an ignored directory can't be re-included
+func (g *GitIgnore) Ignored(path string, isDir bool) (bool, error) {
+	rel, err := filepath.Rel(g.root, path)
+	if err != nil {
+		return false, err
+	}
+	if rel == "." {
+		return false, nil
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	ignored := false
+	for i := range parts {
+		patterns, err := g.load(strings.Join(parts[:i], "/"))
+		if err != nil {
+			return false, err
+		}
+		sub := strings.Join(parts[i:], "/")
+		for _, p := range patterns {
+			if p.Match(sub, isDir) {
+				ignored = !p.Negate
+			}
+		}
+	}
+	return ignored, nil
+}
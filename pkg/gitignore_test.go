@@ -0,0 +1,215 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGlobPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		// unanchored patterns match at any level
+		{"*.log", "a.log", false, true},
+		{"*.log", "dir/sub/a.log", false, true},
+		{"*.log", "a.log.txt", false, false},
+		{"build", "src/build", true, true},
+		// a slash at the beginning or middle anchors
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"doc/*.txt", "doc/a.txt", false, true},
+		{"doc/*.txt", "src/doc/a.txt", false, false},
+		{"doc/*.txt", "doc/sub/a.txt", false, false},
+		// **
+		{"**/temp", "temp", true, true},
+		{"**/temp", "a/b/temp", true, true},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"a/**/b", "x/a/b", false, false},
+		{"dist/**", "dist/a/b.js", false, true},
+		{"dist/**", "dist", true, false},
+		// a trailing slash matches only directories
+		{"cache/", "cache", true, true},
+		{"cache/", "cache", false, false},
+		{"cache/", "src/cache", true, true},
+		// ! negates, Match itself ignores it
+		{"!keep.log", "keep.log", false, true},
+		{"?.txt", "a.txt", false, true},
+		{"?.txt", "ab.txt", false, false},
+		{"[a-c].txt", "b.txt", false, true},
+		{"[!a-c].txt", "b.txt", false, false},
+		{`\#file`, "#file", false, true},
+		{`\!file`, "!file", false, true},
+	}
+	for _, tt := range tests {
+		p, err := ParseGlobPattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("ParseGlobPattern(%q): %v", tt.pattern, err)
+		}
+		if got := p.Match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("%q.Match(%q, %v) = %v, want %v", tt.pattern, tt.path, tt.isDir, got, tt.want)
+		}
+	}
+	for _, line := range []string{"", "   ", "# comment", "!", "/"} {
+		if p, err := ParseGlobPattern(line); p != nil || err != nil {
+			t.Errorf("ParseGlobPattern(%q) = %v, %v, want nil", line, p, err)
+		}
+	}
+}
+
+func TestMatchGlobPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		want     bool
+	}{
+		{nil, "a.go", false},
+		{[]string{"*.go"}, "a.go", true},
+		{[]string{"*.go", "!*_test.go"}, "a_test.go", false},
+		// the last matching pattern decides, so a later pattern re-includes
+		{[]string{"*.go", "!*_test.go", "pkg/*_test.go"}, "pkg/a_test.go", true},
+		{[]string{"!*_test.go", "*.go"}, "a_test.go", true},
+		// a negation alone never includes
+		{[]string{"!*.md"}, "a.go", false},
+	}
+	for _, tt := range tests {
+		var patterns []*GlobPattern
+		for _, s := range tt.patterns {
+			p, err := ParseGlobPattern(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			patterns = append(patterns, p)
+		}
+		if got := MatchGlobPatterns(patterns, tt.path, false); got != tt.want {
+			t.Errorf("MatchGlobPatterns(%q, %q) = %v, want %v", tt.patterns, tt.path, got, tt.want)
+		}
+	}
+}
+
+// writeTree creates files with their content under a temporary directory
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestGitIgnore(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		".gitignore":          "*.log\n!keep.log\n/build/\nnode_modules/\n",
+		".ignore":             "# a later file overrides\n!important.log\n",
+		"src/.gitignore":      "!debug.log\ngen/\n/local.go\n",
+		"src/gen/x.go":        "",
+		"src/sub/local.go":    "",
+		"src/build/main.go":   "",
+		"src/node_modules/x":  "",
+		"src/sub/.gitignore":  "*.go\n!main.go\n",
+		"src/sub/main.go":     "",
+		"src/sub/main.go.log": "",
+	})
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"a.log", false, true},
+		{"src/a.log", false, true},
+		{"keep.log", false, false},
+		{"src/keep.log", false, false},
+		{"important.log", false, false},
+		// a deeper file overrides
+		{"src/debug.log", false, false},
+		{"debug.log", false, true},
+		// anchored to the directory of the file
+		{"build", true, true},
+		{"src/build", true, false},
+		{"src/local.go", false, true},
+		{"src/sub/local.go", false, true},
+		// dir only
+		{"node_modules", true, true},
+		{"src/node_modules", true, true},
+		{"node_modules", false, false},
+		{"src/gen", true, true},
+		{"gen", true, false},
+		{"src/sub/util.go", false, true},
+		{"src/sub/main.go", false, false},
+		{"src/sub/main.go.log", false, true},
+		{"src/main.go", false, false},
+	}
+	g := NewGitIgnore(root)
+	for _, tt := range tests {
+		got, err := g.Ignored(filepath.Join(root, filepath.FromSlash(tt.path)), tt.isDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Ignored(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+// TestGitIgnoreIncludes checks how zip combines the ignore files with --include, a file is archived only if it's
+// not ignored and included, so a negated include can't bring back an ignored file and vice versa
+func TestGitIgnoreIncludes(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		".gitignore": "*.log\n!keep.log\ngen/\n",
+	})
+	includes := []string{"*.go", "*.log", "!*_test.go", "!skip.log"}
+	var patterns []*GlobPattern
+	for _, s := range includes {
+		p, err := ParseGlobPattern(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patterns = append(patterns, p)
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"main.go", true},
+		{"main_test.go", false},
+		{"README.md", false},
+		{"a.log", false},
+		{"keep.log", true},
+		{"skip.log", false},
+		{"gen/x.go", false},
+	}
+	g := NewGitIgnore(root)
+	for _, tt := range tests {
+		ignored := false
+		// a walk skips ignored directories, so the parents are checked first
+		parts := strings.Split(tt.path, "/")
+		for i := 1; i < len(parts) && !ignored; i++ {
+			skip, err := g.Ignored(filepath.Join(root, filepath.Join(parts[:i]...)), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ignored = skip
+		}
+		if !ignored {
+			skip, err := g.Ignored(filepath.Join(root, filepath.FromSlash(tt.path)), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ignored = skip
+		}
+		if got := !ignored && MatchGlobPatterns(patterns, tt.path, false); got != tt.want {
+			t.Errorf("%q archived = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
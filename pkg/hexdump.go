@@ -0,0 +1,34 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HexDump formats b like `hexdump -C`, offset is the address of the first byte
+func HexDump(b []byte, offset int64) string {
+	buf := &strings.Builder{}
+	for i := 0; i < len(b); i += 16 {
+		line := b[i:min(i+16, len(b))]
+		fmt.Fprintf(buf, "%08x  ", offset+int64(i))
+		for j := range 16 {
+			if j < len(line) {
+				fmt.Fprintf(buf, "%02x ", line[j])
+			} else {
+				buf.WriteString("   ")
+			}
+			if j == 7 {
+				buf.WriteByte(' ')
+			}
+		}
+		buf.WriteString(" |")
+		for _, c := range line {
+			if c < 32 || c > 126 {
+				c = '.'
+			}
+			buf.WriteByte(c)
+		}
+		buf.WriteString("|\n")
+	}
+	return buf.String()
+}
@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// MaxExpandedHosts limits the number of addresses a single target can be expanded to
+const MaxExpandedHosts = 1 << 16
+
+// ExpandHosts expands cidr (10.0.0.0/24) and dash range (10.0.0.1-50, 10.0.0.1-10.0.1.20) to ip addresses,
+// ok is false if target is neither of them, eg. a domain name or a single ip
+func ExpandHosts(target string) (ips []string, ok bool, err error) {
+	if strings.Contains(target, "/") {
+		prefix, err := netip.ParsePrefix(target)
+		if err != nil {
+			return nil, true, err
+		}
+		if prefix.Addr().BitLen()-prefix.Bits() > 16 {
+			return nil, true, fmt.Errorf("%s: too many addresses, maximum %d", target, MaxExpandedHosts)
+		}
+		for addr := prefix.Masked().Addr(); addr.IsValid() && prefix.Contains(addr); addr = addr.Next() {
+			ips = append(ips, addr.String())
+		}
+		return ips, true, nil
+	}
+	i := strings.LastIndex(target, "-")
+	if i < 0 {
+		return nil, false, nil
+	}
+	start, err := netip.ParseAddr(target[:i])
+	if err != nil {
+		// a domain name with dash
+		return nil, false, nil
+	}
+	end, err := netip.ParseAddr(target[i+1:])
+	if err != nil {
+		// only the last octet is given, eg. 10.0.0.1-50
+		n, convErr := strconv.Atoi(target[i+1:])
+		if convErr != nil || !start.Is4() || n < 0 || n > 255 {
+			return nil, true, fmt.Errorf("invalid range: %s", target)
+		}
+		b := start.As4()
+		b[3] = byte(n)
+		end = netip.AddrFrom4(b)
+	}
+	if start.BitLen() != end.BitLen() || end.Less(start) {
+		return nil, true, fmt.Errorf("invalid range: %s", target)
+	}
+	for addr := start; addr.IsValid() && !end.Less(addr); addr = addr.Next() {
+		if len(ips) >= MaxExpandedHosts {
+			return nil, true, fmt.Errorf("%s: too many addresses, maximum %d", target, MaxExpandedHosts)
+		}
+		ips = append(ips, addr.String())
+	}
+	return ips, true, nil
+}
@@ -2,44 +2,285 @@ package pkg
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	gnet "github.com/shirou/gopsutil/v4/net"
+	"github.com/shirou/gopsutil/v4/process"
 )
 
-// kind must be one of "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "inet", "inet4", "inet6"
-//
-// default signal is os.Kill
-func KillPortProcess(port int, kind string) error {
-	p := uint32(port)
-	switch kind {
-	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "inet", "inet4", "inet6":
-	default:
-		return errors.New("kind must be one of tcp, tcp4, tcp6, udp, udp4, udp6, inet, inet4, inet6")
+// PortProcess is a connection on a local port and the process owning it
+type PortProcess struct {
+	PID  int32
+	Name string
+	User string
+	// Cmdline is empty if it can't be read, eg. the process belongs to another user
+	Cmdline string
+	// Proto is tcp, tcp6, udp or udp6
+	Proto string
+	// Port is the local port
+	Port int
+	// State is the tcp state, eg. LISTEN, ESTABLISHED, empty for udp
+	State string
+	Laddr string
+	Raddr string
+	// Started is zero if unknown
+	Started time.Time
+}
+
+// ListPortProcesses returns the connections selected by filter and their processes, sorted by port and pid
+func ListPortProcesses(filter *PortFilter) ([]*PortProcess, error) {
+	kind, err := filter.kind()
+	if err != nil {
+		return nil, err
 	}
 	connections, err := gnet.Connections(kind)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	pidMap := make(map[int]struct{})
+	portSet := make(map[uint32]struct{})
+	for _, p := range filter.Ports {
+		portSet[uint32(p)] = struct{}{}
+	}
+	var result []*PortProcess
+	infos := make(map[int32]*PortProcess)
 	for _, conn := range connections {
-		if conn.Laddr.Port == p {
-			pid := int(conn.Pid)
-			if _, ok := pidMap[pid]; ok {
-				continue
-			}
-			pidMap[pid] = struct{}{}
-			process, err := os.FindProcess(pid)
-			if err != nil {
-				continue
-			}
-			if !processExists(process) {
-				continue
+		if _, ok := portSet[conn.Laddr.Port]; !ok && len(portSet) > 0 {
+			continue
+		}
+		info, ok := infos[conn.Pid]
+		if !ok {
+			info = processInfo(conn.Pid)
+			infos[conn.Pid] = info
+		}
+		pp := *info
+		pp.Proto = connProto(conn)
+		pp.Port = int(conn.Laddr.Port)
+		if conn.Type == syscall.SOCK_STREAM {
+			pp.State = conn.Status
+		}
+		pp.Laddr = formatConnAddr(conn.Laddr)
+		if conn.Raddr.IP != "" && conn.Raddr.Port != 0 {
+			pp.Raddr = formatConnAddr(conn.Raddr)
+		}
+		if filter.Match(&pp) {
+			result = append(result, &pp)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Port != result[j].Port {
+			return result[i].Port < result[j].Port
+		}
+		return result[i].PID < result[j].PID
+	})
+	return result, nil
+}
+
+// processInfo fills in what can be read, the pid is 0 if the owner is unknown, eg. a socket of another user
+func processInfo(pid int32) *PortProcess {
+	info := &PortProcess{PID: pid}
+	if pid <= 0 {
+		return info
+	}
+	p, err := process.NewProcess(pid)
+	if err != nil {
+		return info
+	}
+	info.Name, _ = p.Name()
+	info.User, _ = p.Username()
+	info.Cmdline, _ = p.Cmdline()
+	if ms, err := p.CreateTime(); err == nil {
+		info.Started = time.UnixMilli(ms)
+	}
+	return info
+}
+
+func connProto(conn gnet.ConnectionStat) string {
+	proto := "tcp"
+	if conn.Type == syscall.SOCK_DGRAM {
+		proto = "udp"
+	}
+	if conn.Family == syscall.AF_INET6 {
+		proto += "6"
+	}
+	return proto
+}
+
+func formatConnAddr(addr gnet.Addr) string {
+	if addr.IP == "" {
+		return fmt.Sprintf("*:%d", addr.Port)
+	}
+	return net.JoinHostPort(addr.IP, strconv.FormatUint(uint64(addr.Port), 10))
+}
+
+// KillTarget is a process occupying some of the ports
+type KillTarget struct {
+	PID     int32
+	Name    string
+	Cmdline string
+	Ports   []int
+}
+
+// KillOptions controls how KillProcesses signals targets
+type KillOptions struct {
+	// Signal is sent first, default os.Kill
+	Signal os.Signal
+	// Grace is how long to wait for the ports to be released before sending SIGKILL, 0 means no escalation
+	Grace time.Duration
+	// Kind is used to check whether the ports are released, default tcp
+	Kind string
+}
+
+// KillResult is the outcome of signalling a target
+type KillResult struct {
+	*KillTarget
+	Signal string
+	// Escalated is true if the target held the ports past the grace period and got SIGKILL
+	Escalated bool
+	Err       error
+}
+
+var signalNames = map[string]os.Signal{
+	"TERM": syscall.SIGTERM,
+	"INT":  syscall.SIGINT,
+	"HUP":  syscall.SIGHUP,
+	"KILL": syscall.SIGKILL,
+}
+
+// ParseSignal parses TERM, INT, HUP or KILL, case insensitive with or without the SIG prefix
+func ParseSignal(name string) (os.Signal, error) {
+	if sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]; ok {
+		if !SignalsSupported && sig != os.Kill {
+			return nil, fmt.Errorf("signal %s is not supported on %s, only KILL is", name, runtime.GOOS)
+		}
+		return sig, nil
+	}
+	return nil, fmt.Errorf("unsupported signal %s, must be one of TERM, INT, HUP, KILL", name)
+}
+
+// SignalName returns the short name of sig, eg. TERM
+func SignalName(sig os.Signal) string {
+	for name, s := range signalNames {
+		if s == sig {
+			return name
+		}
+	}
+	return sig.String()
+}
+
+// FindKillTargets returns the processes of the connections selected by filter ordered by pid,
+// sockets whose owner is unknown are skipped
+func FindKillTargets(filter *PortFilter) ([]*KillTarget, error) {
+	processes, err := ListPortProcesses(filter)
+	if err != nil {
+		return nil, err
+	}
+	var targets []*KillTarget
+	byPID := make(map[int32]*KillTarget)
+	for _, p := range processes {
+		if p.PID <= 0 {
+			continue
+		}
+		t, ok := byPID[p.PID]
+		if !ok {
+			t = &KillTarget{PID: p.PID, Name: p.Name, Cmdline: p.Cmdline}
+			byPID[p.PID] = t
+			targets = append(targets, t)
+		}
+		if !slices.Contains(t.Ports, p.Port) {
+			t.Ports = append(t.Ports, p.Port)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].PID < targets[j].PID
+	})
+	return targets, nil
+}
+
+// KillProcesses signals every target and returns a result per target, an error doesn't stop the others
+func KillProcesses(targets []*KillTarget, opts KillOptions) []*KillResult {
+	sig := opts.Signal
+	if sig == nil {
+		sig = os.Kill
+	}
+	kind := opts.Kind
+	if kind == "" {
+		kind = "tcp"
+	}
+	results := make([]*KillResult, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		r := &KillResult{KillTarget: t, Signal: SignalName(sig)}
+		results[i] = r
+		process, err := os.FindProcess(int(t.PID))
+		if err == nil && !processExists(process) {
+			err = os.ErrProcessDone
+		}
+		if err == nil {
+			err = process.Signal(sig)
+		}
+		if err != nil {
+			r.Err = err
+			continue
+		}
+		if opts.Grace <= 0 || sig == os.Kill {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if waitPortsReleased(t, kind, opts.Grace) {
+				return
 			}
-			err = process.Signal(os.Kill)
-			if err != nil {
-				return err
+			r.Escalated = true
+			if err := process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+				r.Err = err
 			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// waitPortsReleased polls until the target exits or holds none of its ports, false if it still does after timeout
+func waitPortsReleased(t *KillTarget, kind string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if process, err := os.FindProcess(int(t.PID)); err != nil || !processExists(process) {
+			return true
+		}
+		connections, err := gnet.ConnectionsPid(kind, t.PID)
+		if err == nil && !slices.ContainsFunc(connections, func(conn gnet.ConnectionStat) bool {
+			return slices.Contains(t.Ports, int(conn.Laddr.Port))
+		}) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// KillPortProcess sends os.Kill to every process listening on the port and returns the first error,
+// processes already exited are not errors, kind is the same as PortFilter.Kind
+func KillPortProcess(port int, kind string) error {
+	targets, err := FindKillTargets(&PortFilter{Ports: []int{port}, Kind: kind, Listen: true})
+	if err != nil {
+		return err
+	}
+	for _, r := range KillProcesses(targets, KillOptions{Kind: kind}) {
+		if r.Err != nil && !errors.Is(r.Err, os.ErrProcessDone) {
+			return r.Err
 		}
 	}
 	return nil
@@ -6,6 +6,9 @@ import (
 	"os"
 )
 
+// SignalsSupported is false as windows can only kill processes, os.Process.Signal fails for any other signal
+const SignalsSupported = false
+
 func processExists(_ *os.Process) bool {
 	return true
 }
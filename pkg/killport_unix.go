@@ -7,6 +7,9 @@ import (
 	"syscall"
 )
 
+// SignalsSupported reports whether signals other than KILL can be sent
+const SignalsSupported = true
+
 func processExists(p *os.Process) bool {
 	err := p.Signal(syscall.Signal(0))
 	return err == nil
@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PortFilter selects the connections of ListPortProcesses and FindKillTargets
+type PortFilter struct {
+	// Ports are local ports, empty means all
+	Ports []int
+	// Kind must be one of "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "inet", "inet4", "inet6", default tcp
+	Kind string
+	// Listen matches listening tcp sockets and udp sockets without a remote address
+	Listen bool
+	// Established matches established tcp connections and connected udp sockets,
+	// neither Listen nor Established means any state
+	Established bool
+	// PID is matched against the decimal pid, nil matches all
+	PID *regexp.Regexp
+	// Name is matched against the process name, nil matches all
+	Name *regexp.Regexp
+}
+
+// NewPortFilter validates kind and expands the ports and ranges of args, eg. 8080 or 3000-3010,
+// duplicates are dropped and the order is kept
+func NewPortFilter(kind string, args []string) (*PortFilter, error) {
+	f := &PortFilter{Kind: kind}
+	if _, err := f.kind(); err != nil {
+		return nil, err
+	}
+	seen := make(map[int]struct{})
+	for _, arg := range args {
+		expanded, err := ParsePortRanges(arg)
+		if err == nil && len(expanded) == 0 {
+			err = errors.New("empty port range")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid port: %w", arg, err)
+		}
+		for _, p := range expanded {
+			if _, ok := seen[p]; !ok {
+				seen[p] = struct{}{}
+				f.Ports = append(f.Ports, p)
+			}
+		}
+	}
+	return f, nil
+}
+
+func (f *PortFilter) kind() (string, error) {
+	switch f.Kind {
+	case "":
+		return "tcp", nil
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "inet", "inet4", "inet6":
+		return f.Kind, nil
+	default:
+		return "", errors.New("kind must be one of tcp, tcp4, tcp6, udp, udp4, udp6, inet, inet4, inet6")
+	}
+}
+
+// matchState reports whether the connection of p is in a selected state
+func (f *PortFilter) matchState(p *PortProcess) bool {
+	if !f.Listen && !f.Established {
+		return true
+	}
+	isUDP := p.Proto == "udp" || p.Proto == "udp6"
+	if f.Listen && (p.State == "LISTEN" || isUDP && p.Raddr == "") {
+		return true
+	}
+	return f.Established && (p.State == "ESTABLISHED" || isUDP && p.Raddr != "")
+}
+
+// Match reports whether p passes the state, pid and name filters, ports are matched while listing
+func (f *PortFilter) Match(p *PortProcess) bool {
+	if !f.matchState(p) {
+		return false
+	}
+	if f.PID != nil && !f.PID.MatchString(strconv.Itoa(int(p.PID))) {
+		return false
+	}
+	return f.Name == nil || f.Name.MatchString(p.Name)
+}
+
+// ParsePortRanges parses comma separated ports and ranges, eg. 1-1024,3306
+func ParsePortRanges(s string) ([]int, error) {
+	var ports []int
+	err := RangePortRanges(s, func(start, end int) {
+		for p := start; p <= end; p++ {
+			ports = append(ports, p)
+		}
+	})
+	return ports, err
+}
+
+// RangePortRanges calls f with the first and last port of every part of comma separated ports and ranges
+func RangePortRanges(s string, f func(start, end int)) error {
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return fmt.Errorf("invalid port range: %s", part)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil {
+				return fmt.Errorf("invalid port range: %s", part)
+			}
+		}
+		// checked before expanding, a huge range would exhaust the memory
+		if start < 0 || end > 65535 {
+			return fmt.Errorf("invalid port range: %s, ports must be between 0 and 65535", part)
+		}
+		if start > end {
+			return fmt.Errorf("invalid port range: %s, start is greater than end", part)
+		}
+		f(start, end)
+	}
+	return nil
+}
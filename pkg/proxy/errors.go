@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrProtocol is wrapped by errors of a proxy which breaks the protocol of the scheme or doesn't answer before
+// the connect request, eg. a socks5 proxy dialed as socks4. Unlike a ReplyError it tells nothing about the target.
+var ErrProtocol = errors.New("proxy protocol error")
+
+// ReplyError is a failure reply of a proxy to the connect request, as opposed to errors of reaching or
+// talking to the proxy itself, which are returned as is.
+type ReplyError struct {
+	// Scheme is the scheme of the proxy which replied
+	Scheme string
+	// Code is the SOCKS reply code or the HTTP status code
+	Code int
+	Msg  string
+	// Body is the beginning of the HTTP response body, which often tells the cause
+	Body string
+}
+
+func (e *ReplyError) Error() string {
+	if e.Body != "" {
+		return e.Msg + ": " + e.Body
+	}
+	return e.Msg
+}
+
+// Refused reports whether the proxy says the target refused the connection
+func (e *ReplyError) Refused() bool {
+	switch e.Scheme {
+	case "socks5", "socks5h":
+		return e.Code == 0x05
+	case "http", "https":
+		return (e.Code == 502 || e.Code == 503) && strings.Contains(strings.ToLower(e.Body), "refused")
+	}
+	return false
+}
+
+// Unreachable reports whether the proxy says the target is unreachable or didn't answer in time
+func (e *ReplyError) Unreachable() bool {
+	switch e.Scheme {
+	case "socks5", "socks5h":
+		// network unreachable, host unreachable, TTL expired
+		return e.Code == 0x03 || e.Code == 0x04 || e.Code == 0x06
+	case "http", "https":
+		if e.Code == 504 {
+			return true
+		}
+		body := strings.ToLower(e.Body)
+		return (e.Code == 502 || e.Code == 503) &&
+			(strings.Contains(body, "unreachable") || strings.Contains(body, "timed out") || strings.Contains(body, "timeout"))
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// connectHTTP sends a CONNECT request, the returned conn wraps conn if u is https
+func connectHTTP(ctx context.Context, conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: u.Hostname(),
+			NextProtos: []string{"http/1.1"},
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return conn, err
+		}
+		conn = tlsConn
+	}
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		Host:       addr,
+		RequestURI: addr,
+		URL:        &url.URL{Host: addr},
+		Header:     http.Header{},
+	}
+	if user := u.User; user != nil {
+		pwd, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+pwd)))
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+	bufR := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(bufR, req)
+	if err != nil {
+		var netErr net.Error
+		if !errors.As(err, &netErr) && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			// eg. malformed HTTP response of a socks proxy
+			return conn, fmt.Errorf("%w: %w", ErrProtocol, err)
+		}
+		return conn, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		replyErr := &ReplyError{Scheme: u.Scheme, Code: resp.StatusCode, Msg: resp.Status}
+		if body, _ := io.ReadAll(io.LimitReader(resp.Body, 512)); len(body) > 0 {
+			replyErr.Body = strings.TrimSpace(string(body))
+		}
+		return conn, replyErr
+	}
+	if bufR.Buffered() == 0 {
+		return conn, nil
+	}
+	return &readerConn{reader: bufR, Conn: conn}, nil
+}
@@ -0,0 +1,547 @@
+package proxy
+
+import (
+	"awake/pkg"
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Server serves socks5 and http proxy on the same listener, the protocol is sniffed from the first byte.
+type Server struct {
+	// Username and Password enable authentication when Username is not empty
+	Username string
+	Password string
+	// Allow and Deny filter clients by source ip, Deny takes precedence, empty Allow means all clients
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+	// Dialer connects to the targets, nil means direct connection
+	Dialer *Dialer
+	// Logger logs every connection, nil means pkg.NewLogger()
+	Logger *pkg.Logger
+	// HandshakeTimeout limits reading the greeting and every request of a client, 0 means 10s
+	HandshakeTimeout time.Duration
+}
+
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn handles one client connection and closes it
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	logger := s.logger()
+	client := conn.RemoteAddr().String()
+	if !s.isAllowed(conn.RemoteAddr()) {
+		logger.Warnf("%s denied by access list", client)
+		return
+	}
+	// a client sending a partial greeting is dropped instead of holding the connection
+	s.setHandshakeDeadline(conn)
+	br := bufio.NewReader(conn)
+	b, err := br.Peek(1)
+	if err != nil {
+		logger.Debugf("%s %v", client, err)
+		return
+	}
+	bc := &readerConn{reader: br, Conn: conn}
+	if b[0] == socks5Version {
+		err = s.serveSOCKS5(bc)
+	} else {
+		err = s.serveHTTP(bc)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		logger.Warnf("%s %v", client, err)
+	}
+}
+
+// setHandshakeDeadline limits the reads and writes of the handshake, clear it with conn.SetDeadline(time.Time{})
+func (s *Server) setHandshakeDeadline(conn net.Conn) {
+	timeout := s.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+}
+
+func (s *Server) logger() *pkg.Logger {
+	if s.Logger == nil {
+		return pkg.NewLogger()
+	}
+	return s.Logger
+}
+
+func (s *Server) dialer() *Dialer {
+	if s.Dialer == nil {
+		return &Dialer{}
+	}
+	return s.Dialer
+}
+
+func (s *Server) isAllowed(addr net.Addr) bool {
+	var ip net.IP
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		ip = v.IP
+	case *net.UDPAddr:
+		ip = v.IP
+	default:
+		// unix sockets and others
+		return len(s.Allow) == 0
+	}
+	for _, n := range s.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(s.Allow) == 0 {
+		return true
+	}
+	for _, n := range s.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) checkAuth(user, pwd string) bool {
+	return subtle.ConstantTimeCompare([]byte(user), []byte(s.Username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(pwd), []byte(s.Password)) == 1
+}
+
+func (s *Server) dial(addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return s.dialer().DialContext(ctx, "tcp", addr)
+}
+
+// tunnel relays between the client and the target, logging traffic when done
+func (s *Server) tunnel(proto string, client, target net.Conn, addr string) {
+	logger := s.logger()
+	logger.Infof("[%s] %s -> %s connected", proto, client.RemoteAddr(), addr)
+	start := time.Now()
+	sent, received := relay(client, target)
+	logger.Infof("[%s] %s -> %s closed, sent %s, received %s, duration %s", proto, client.RemoteAddr(), addr,
+		pkg.FormatSize(sent), pkg.FormatSize(received), time.Since(start).Round(time.Millisecond))
+}
+
+// relay copies data in both directions, both connections are closed as soon as either direction is done
+func relay(left, right net.Conn) (sent int64, received int64) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		received, _ = io.Copy(left, right)
+		left.Close()
+		right.Close()
+	}()
+	sent, _ = io.Copy(right, left)
+	left.Close()
+	right.Close()
+	wg.Wait()
+	return
+}
+
+const (
+	socks5RepSucceeded          = 0x00
+	socks5RepFailure            = 0x01
+	socks5RepNotAllowed         = 0x02
+	socks5RepNetUnreachable     = 0x03
+	socks5RepHostUnreachable    = 0x04
+	socks5RepConnRefused        = 0x05
+	socks5RepTTLExpired         = 0x06
+	socks5RepCmdNotSupported    = 0x07
+	socks5RepAddrTypeNotSupport = 0x08
+)
+
+func (s *Server) serveSOCKS5(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	method := byte(socks5AuthNone)
+	if s.Username != "" {
+		method = socks5AuthPassword
+	}
+	found := false
+	for _, m := range methods {
+		if m == method {
+			found = true
+			break
+		}
+	}
+	if !found {
+		conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return errors.New("socks5: no acceptable authentication methods")
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	if method == socks5AuthPassword {
+		// https://www.rfc-editor.org/rfc/rfc1929
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return err
+		}
+		user := make([]byte, header[1])
+		if _, err := io.ReadFull(conn, user); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, header[:1]); err != nil {
+			return err
+		}
+		pwd := make([]byte, header[0])
+		if _, err := io.ReadFull(conn, pwd); err != nil {
+			return err
+		}
+		if !s.checkAuth(string(user), string(pwd)) {
+			conn.Write([]byte{0x01, 0x01})
+			return fmt.Errorf("socks5: authentication failed for user %q", user)
+		}
+		if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+			return err
+		}
+	}
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return err
+	}
+	if req[0] != socks5Version {
+		return fmt.Errorf("socks5: unexpected version %d", req[0])
+	}
+	addr, err := readSOCKS5Addr(conn)
+	if err != nil {
+		writeSOCKS5Reply(conn, socks5RepAddrTypeNotSupport, nil)
+		return err
+	}
+	// the dial has its own timeout, the tunnel and the udp association may idle for long
+	conn.SetDeadline(time.Time{})
+	switch req[1] {
+	case socks5CmdConnect:
+		target, err := s.dial(addr)
+		if err != nil {
+			writeSOCKS5Reply(conn, socks5ReplyCode(err), nil)
+			return fmt.Errorf("socks5: connect %s: %w", addr, err)
+		}
+		if err := writeSOCKS5Reply(conn, socks5RepSucceeded, target.LocalAddr()); err != nil {
+			target.Close()
+			return err
+		}
+		s.tunnel("socks5", conn, target, addr)
+		return nil
+	case socks5CmdUDPAssociate:
+		if s.Dialer != nil && (len(s.Dialer.Chain) > 0 || s.Dialer.env) {
+			// the upstream chain is tcp only, refuse instead of leaking udp traffic directly
+			writeSOCKS5Reply(conn, socks5RepCmdNotSupported, nil)
+			return errors.New("socks5: udp associate is not supported with upstream proxy")
+		}
+		return s.udpAssociate(conn)
+	default:
+		writeSOCKS5Reply(conn, socks5RepCmdNotSupported, nil)
+		return fmt.Errorf("socks5: unsupported command 0x%02x", req[1])
+	}
+}
+
+// readSOCKS5Addr reads ATYP, DST.ADDR and DST.PORT, returns host:port
+func readSOCKS5Addr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		if _, err := io.ReadFull(r, atyp); err != nil {
+			return "", err
+		}
+		domain := make([]byte, atyp[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("socks5: unknown address type 0x%02x", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func writeSOCKS5Reply(w io.Writer, rep byte, bound net.Addr) error {
+	var (
+		ip   net.IP = net.IPv4zero
+		port int
+	)
+	switch v := bound.(type) {
+	case *net.TCPAddr:
+		ip, port = v.IP, v.Port
+	case *net.UDPAddr:
+		ip, port = v.IP, v.Port
+	}
+	b := AppendSOCKS5Addr([]byte{socks5Version, rep, 0x00}, ip, "")
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+	_, err := w.Write(b)
+	return err
+}
+
+func socks5ReplyCode(err error) byte {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5RepConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5RepNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socks5RepHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socks5RepTTLExpired
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socks5RepHostUnreachable
+	}
+	return socks5RepFailure
+}
+
+// udpAssociate relays udp datagrams for the client until the control connection is closed
+//
+// https://www.rfc-editor.org/rfc/rfc1928#section-7
+func (s *Server) udpAssociate(conn net.Conn) error {
+	logger := s.logger()
+	var localIP net.IP
+	if v, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = v.IP
+	}
+	var clientIP net.IP
+	if v, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = v.IP
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		writeSOCKS5Reply(conn, socks5RepFailure, nil)
+		return err
+	}
+	defer pc.Close()
+	if err := writeSOCKS5Reply(conn, socks5RepSucceeded, pc.LocalAddr()); err != nil {
+		return err
+	}
+	logger.Infof("[socks5] %s udp associate on %s", conn.RemoteAddr(), pc.LocalAddr())
+	go func() {
+		// the association terminates when the tcp connection closes
+		io.Copy(io.Discard, conn)
+		pc.Close()
+	}()
+	var (
+		clientAddr *net.UDPAddr
+		sent       int64
+		received   int64
+	)
+	start := time.Now()
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		if from.IP.Equal(clientIP) && (clientAddr == nil || from.Port == clientAddr.Port) {
+			clientAddr = from
+			// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA
+			if n < 4 || buf[2] != 0 {
+				continue
+			}
+			r := &sliceReader{b: buf[3:n]}
+			addr, err := readSOCKS5Addr(r)
+			if err != nil {
+				continue
+			}
+			udpAddr, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				logger.Debugf("[socks5] %s udp %v", from, err)
+				continue
+			}
+			if m, err := pc.WriteToUDP(r.b, udpAddr); err == nil {
+				sent += int64(m)
+			}
+			continue
+		}
+		if clientAddr == nil {
+			continue
+		}
+		b := AppendSOCKS5Addr([]byte{0, 0, 0}, from.IP, "")
+		b = binary.BigEndian.AppendUint16(b, uint16(from.Port))
+		b = append(b, buf[:n]...)
+		if _, err := pc.WriteToUDP(b, clientAddr); err == nil {
+			received += int64(n)
+		}
+	}
+	logger.Infof("[socks5] %s udp associate closed, sent %s, received %s, duration %s", conn.RemoteAddr(),
+		pkg.FormatSize(sent), pkg.FormatSize(received), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+type sliceReader struct {
+	b []byte
+}
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+// hop-by-hop headers, https://www.rfc-editor.org/rfc/rfc9110#section-7.6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+func (s *Server) serveHTTP(conn *readerConn) error {
+	transport := &http.Transport{
+		DialContext:           s.dialer().DialContext,
+		MaxIdleConns:          16,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	defer transport.CloseIdleConnections()
+	logger := s.logger()
+	for {
+		// also closes keep-alive connections idle for longer than the timeout
+		s.setHandshakeDeadline(conn)
+		req, err := http.ReadRequest(conn.reader)
+		if err != nil {
+			return err
+		}
+		conn.SetDeadline(time.Time{})
+		if s.Username != "" {
+			user, pwd, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization"))
+			if !ok || !s.checkAuth(user, pwd) {
+				resp := &http.Response{
+					StatusCode: http.StatusProxyAuthRequired,
+					ProtoMajor: 1,
+					ProtoMinor: 1,
+					Header:     http.Header{"Proxy-Authenticate": {`Basic realm="awake"`}},
+					Close:      true,
+				}
+				resp.Write(conn)
+				return fmt.Errorf("http: authentication failed for user %q", user)
+			}
+		}
+		if req.Method == http.MethodConnect {
+			addr := req.Host
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				addr = net.JoinHostPort(addr, "443")
+			}
+			target, err := s.dial(addr)
+			if err != nil {
+				writeHTTPError(conn, http.StatusBadGateway, err)
+				return fmt.Errorf("http: connect %s: %w", addr, err)
+			}
+			if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+				target.Close()
+				return err
+			}
+			s.tunnel("http", conn, target, addr)
+			return nil
+		}
+		if !req.URL.IsAbs() {
+			writeHTTPError(conn, http.StatusBadRequest, errors.New("this is a proxy server, absolute url is required"))
+			return fmt.Errorf("http: non-proxy request %s %s", req.Method, req.RequestURI)
+		}
+		req.RequestURI = ""
+		removeHopHeaders(req.Header)
+		start := time.Now()
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			writeHTTPError(conn, http.StatusBadGateway, err)
+			return fmt.Errorf("http: %s %s: %w", req.Method, req.URL, err)
+		}
+		removeHopHeaders(resp.Header)
+		closing := req.Close || resp.Close
+		resp.Close = closing
+		err = resp.Write(conn)
+		resp.Body.Close()
+		logger.Infof("[http] %s %s %s %d, duration %s", conn.RemoteAddr(), req.Method, req.URL, resp.StatusCode,
+			time.Since(start).Round(time.Millisecond))
+		if err != nil {
+			return err
+		}
+		if closing {
+			return nil
+		}
+	}
+}
+
+func parseProxyAuth(auth string) (user, pwd string, ok bool) {
+	v, ok := strings.CutPrefix(auth, "Basic ")
+	if !ok {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+	if err != nil {
+		return "", "", false
+	}
+	user, pwd, ok = strings.Cut(string(b), ":")
+	return
+}
+
+func writeHTTPError(w io.Writer, code int, err error) {
+	body := err.Error() + "\n"
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		code, http.StatusText(code), len(body), body)
+}
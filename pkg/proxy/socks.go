@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// https://www.openssh.com/txt/socks4.protocol
+//
+// https://www.openssh.com/txt/socks4a.protocol
+func connectSOCKS4(ctx context.Context, conn net.Conn, u *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port: %s", portStr)
+	}
+	req := []byte{0x04, 0x01}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	var domain string
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(req, ip.To4()...)
+	} else if u.Scheme == "socks4a" {
+		// 0.0.0.x tells the server that a domain name follows the user id
+		req = append(req, 0, 0, 0, 1)
+		domain = host
+	} else {
+		ip, err := resolveIP(ctx, host, true)
+		if err != nil {
+			return err
+		}
+		req = append(req, ip.To4()...)
+	}
+	if u.User != nil {
+		req = append(req, u.User.Username()...)
+	}
+	req = append(req, 0)
+	if domain != "" {
+		req = append(req, domain...)
+		req = append(req, 0)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 8)
+	if err := readReply(conn, resp, 0x00); err != nil {
+		return err
+	}
+	replyErr := &ReplyError{Scheme: u.Scheme, Code: int(resp[1])}
+	switch resp[1] {
+	case 0x5a:
+		return nil
+	case 0x5b:
+		replyErr.Msg = "request rejected or failed"
+	case 0x5c:
+		replyErr.Msg = "request rejected, cannot connect to identd"
+	case 0x5d:
+		replyErr.Msg = "request rejected, different user id"
+	default:
+		replyErr.Msg = fmt.Sprintf("unknown reply code 0x%02x", resp[1])
+	}
+	return replyErr
+}
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+)
+
+var socks5Replies = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// https://www.rfc-editor.org/rfc/rfc1928
+//
+// socks5 resolves the domain name locally, socks5h lets the proxy resolve it
+func connectSOCKS5(ctx context.Context, conn net.Conn, u *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port: %s", portStr)
+	}
+	// the length of DST.ADDR is a single byte
+	if len(host) > 255 {
+		return errors.New("host name too long")
+	}
+	methods := []byte{socks5AuthNone}
+	if u.User != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	req := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if err := readReply(conn, resp, socks5Version); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && !errors.Is(err, ErrProtocol) {
+			// the greeting doesn't involve the target, a proxy not answering it is broken
+			return fmt.Errorf("%w: no reply to greeting: %w", ErrProtocol, err)
+		}
+		return err
+	}
+	switch resp[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if u.User == nil {
+			return errors.New("proxy requires authentication")
+		}
+		user := u.User.Username()
+		pwd, _ := u.User.Password()
+		if len(user) > 255 || len(pwd) > 255 {
+			return errors.New("username or password too long")
+		}
+		// https://www.rfc-editor.org/rfc/rfc1929
+		req = []byte{0x01, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pwd)))
+		req = append(req, pwd...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	case socks5AuthNoAccept:
+		return errors.New("no acceptable authentication methods")
+	default:
+		return fmt.Errorf("unsupported authentication method 0x%02x", resp[1])
+	}
+
+	req = []byte{socks5Version, socks5CmdConnect, 0x00}
+	ip := net.ParseIP(host)
+	if ip == nil && u.Scheme == "socks5" {
+		ip, err = resolveIP(ctx, host, false)
+		if err != nil {
+			return err
+		}
+	}
+	req = AppendSOCKS5Addr(req, ip, host)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp = make([]byte, 4)
+	if err := readReply(conn, resp, socks5Version); err != nil {
+		return err
+	}
+	if resp[1] != 0x00 {
+		replyErr := &ReplyError{Scheme: u.Scheme, Code: int(resp[1])}
+		if int(resp[1]) < len(socks5Replies) {
+			replyErr.Msg = socks5Replies[resp[1]]
+		} else {
+			replyErr.Msg = fmt.Sprintf("unknown reply code 0x%02x", resp[1])
+		}
+		return replyErr
+	}
+	// skip bound address and port
+	var l int
+	switch resp[3] {
+	case socks5AtypIPv4:
+		l = net.IPv4len
+	case socks5AtypIPv6:
+		l = net.IPv6len
+	case socks5AtypDomain:
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		l = int(b[0])
+	default:
+		return fmt.Errorf("%w: unknown address type 0x%02x", ErrProtocol, resp[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, l+2)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readReply reads a reply of len(b) bytes starting with version, a reply of another version or cut short
+// means the proxy speaks another protocol
+func readReply(conn net.Conn, b []byte, version byte) error {
+	n, err := io.ReadFull(conn, b)
+	if n > 0 && b[0] != version {
+		return fmt.Errorf("%w: unexpected reply version %d", ErrProtocol, b[0])
+	}
+	if n > 0 && err != nil {
+		return fmt.Errorf("%w: reply cut short: %w", ErrProtocol, err)
+	}
+	return err
+}
+
+// AppendSOCKS5Addr appends ATYP and DST.ADDR of a socks5 request, domain is used when ip is nil
+// and must not be longer than 255 bytes
+func AppendSOCKS5Addr(b []byte, ip net.IP, domain string) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AtypIPv4)
+		return append(b, ip4...)
+	}
+	if ip != nil {
+		b = append(b, socks5AtypIPv6)
+		return append(b, ip.To16()...)
+	}
+	b = append(b, socks5AtypDomain, byte(len(domain)))
+	return append(b, domain...)
+}
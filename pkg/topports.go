@@ -0,0 +1,34 @@
+package pkg
+
+// TopTCPPorts are commonly open tcp ports, most frequent first
+var TopTCPPorts = []int{
+	80, 443, 22, 21, 23, 25, 3389, 110, 445, 139, 143, 53, 135, 3306, 8080, 1723, 111, 995, 993, 5900,
+	1025, 587, 8888, 199, 1720, 465, 548, 113, 81, 6001, 10000, 514, 5060, 179, 1026, 2000, 8443, 8000,
+	32768, 554, 26, 1433, 49152, 2001, 515, 8008, 49154, 1027, 5666, 646, 5000, 5631, 631, 49153, 8081,
+	2049, 88, 79, 5800, 106, 2121, 1110, 49155, 6000, 513, 990, 5357, 427, 49156, 543, 544, 5101, 144,
+	7, 389, 8009, 3128, 444, 9999, 5009, 7070, 5190, 3000, 5432, 1900, 3986, 13, 1029, 9, 5051, 6646,
+	49157, 1028, 873, 1755, 2717, 4899, 9100, 119, 37, 6379, 27017, 9200, 11211, 5672, 1883, 8883,
+	9092, 2181, 2379, 6443, 10250, 5601, 9090, 9000, 7001, 8088, 8181, 8880, 8983, 50000, 50070, 4848,
+	5985, 5986, 1521, 3690, 5984, 6667, 25565, 27015, 636, 989, 1080, 1194, 1434, 2082, 2083, 2086,
+	2087, 2095, 2096, 2375, 2376, 3268, 3269, 4369, 4443, 4444, 5222, 5269, 5555, 5938, 6660, 6881,
+	7000, 7443, 8069, 8086, 8089, 8090, 8091, 8123, 8200, 8280, 8291, 8500, 8834, 9042, 9043, 9060,
+	9080, 9091, 9243, 9300, 9418, 9443, 9600, 9876, 10001, 11111, 15672, 16992, 20000, 28017, 30000,
+	31337, 32400, 37777, 44818, 47001, 49158, 49159, 50030, 60000, 61616, 62078,
+}
+
+// TopUDPPorts are commonly open udp ports, most frequent first
+var TopUDPPorts = []int{
+	53, 161, 123, 137, 138, 67, 68, 69, 500, 514, 520, 1900, 4500, 5353, 111, 135, 139, 162, 445, 631,
+	1434, 1701, 1812, 1813, 2049, 3478, 4789, 5060, 5355, 11211, 17185, 19132, 27015, 33434, 47808,
+	49152, 626, 623, 996, 997, 998, 999, 1000, 3283, 5632, 10000, 20031, 177, 427, 1645, 1646, 1027,
+	2048, 32768, 49153,
+}
+
+// TopPorts returns the first n ports of the list, n larger than the list returns all of them
+func TopPorts(n int, udp bool) []int {
+	ports := TopTCPPorts
+	if udp {
+		ports = TopUDPPorts
+	}
+	return ports[:min(max(n, 0), len(ports))]
+}
@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// UDPProbeSize is the size of an encoded UDPProbe
+const UDPProbeSize = 40
+
+var udpProbeMagic = [4]byte{'A', 'W', 'K', 'P'}
+
+const udpProbeVersion = 1
+
+// UDPProbe is the packet exchanged between udping and the udp echo server.
+//
+// Layout in big endian: magic(4) version(1) reply(1) reserved(2) seq(4) received(4)
+// client send(8) server receive(8) server send(8), times are unix nanoseconds.
+type UDPProbe struct {
+	Reply bool
+	Seq   uint32
+	// Received is the number of probes the server has received from the client, including this one
+	Received   uint32
+	ClientSend int64
+	ServerRecv int64
+	ServerSend int64
+}
+
+func (p *UDPProbe) Encode() []byte {
+	b := make([]byte, 0, UDPProbeSize)
+	b = append(b, udpProbeMagic[:]...)
+	b = append(b, udpProbeVersion)
+	if p.Reply {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = append(b, 0, 0)
+	b = binary.BigEndian.AppendUint32(b, p.Seq)
+	b = binary.BigEndian.AppendUint32(b, p.Received)
+	b = binary.BigEndian.AppendUint64(b, uint64(p.ClientSend))
+	b = binary.BigEndian.AppendUint64(b, uint64(p.ServerRecv))
+	b = binary.BigEndian.AppendUint64(b, uint64(p.ServerSend))
+	return b
+}
+
+// DecodeUDPProbe decodes b, extra bytes after the probe are ignored
+func DecodeUDPProbe(b []byte) (*UDPProbe, error) {
+	if len(b) < UDPProbeSize || [4]byte(b[:4]) != udpProbeMagic {
+		return nil, errors.New("not a udp probe")
+	}
+	if b[4] != udpProbeVersion {
+		return nil, errors.New("unsupported udp probe version")
+	}
+	return &UDPProbe{
+		Reply:      b[5] == 1,
+		Seq:        binary.BigEndian.Uint32(b[8:]),
+		Received:   binary.BigEndian.Uint32(b[12:]),
+		ClientSend: int64(binary.BigEndian.Uint64(b[16:])),
+		ServerRecv: int64(binary.BigEndian.Uint64(b[24:])),
+		ServerSend: int64(binary.BigEndian.Uint64(b[32:])),
+	}, nil
+}
+
+// ServerTime is the processing time between receiving and replying, zero if the reply came from a plain echo server
+func (p *UDPProbe) ServerTime() time.Duration {
+	if !p.Reply || p.ServerSend < p.ServerRecv {
+		return 0
+	}
+	return time.Duration(p.ServerSend - p.ServerRecv)
+}
@@ -0,0 +1,378 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// UDPQuery builds requests of a udp protocol and validates the responses
+type UDPQuery interface {
+	// Request builds a new request, the previous one is forgotten
+	Request() []byte
+	// Parse validates b as the response to the last request and returns the decoded answer
+	Parse(b []byte) (string, error)
+}
+
+// NewUDPQuery returns the query of kind "dns", "ntp", "snmp" or "stun", name is the domain name to query for dns
+func NewUDPQuery(kind string, name string) (UDPQuery, error) {
+	switch kind {
+	case "dns":
+		return NewDNSQuery(name, dnsmessage.TypeA)
+	case "ntp":
+		return &NTPQuery{}, nil
+	case "snmp":
+		return &SNMPQuery{Community: "public"}, nil
+	case "stun":
+		return &STUNQuery{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported probe: %s, must be one of dns, ntp, snmp, stun", kind)
+	}
+}
+
+// UDPQueryPort returns the well-known port of the query kind
+func UDPQueryPort(kind string) string {
+	switch kind {
+	case "dns":
+		return "53"
+	case "ntp":
+		return "123"
+	case "snmp":
+		return "161"
+	case "stun":
+		return "3478"
+	}
+	return ""
+}
+
+func randomUint16() uint16 {
+	b := make([]byte, 2)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+type DNSQuery struct {
+	name dnsmessage.Name
+	typ  dnsmessage.Type
+	id   uint16
+}
+
+func NewDNSQuery(name string, typ dnsmessage.Type) (*DNSQuery, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	return &DNSQuery{name: n, typ: typ}, nil
+}
+
+func (q *DNSQuery) Request() []byte {
+	q.id = randomUint16()
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: q.id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: q.name, Type: q.typ, Class: dnsmessage.ClassINET},
+		},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		// the name has been validated
+		panic(err)
+	}
+	return b
+}
+
+func (q *DNSQuery) Parse(b []byte) (string, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(b)
+	if err != nil {
+		return "", err
+	}
+	if !header.Response {
+		return "", errors.New("not a dns response")
+	}
+	if header.ID != q.id {
+		return "", fmt.Errorf("dns id mismatch, expected %d, got %d", q.id, header.ID)
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return "", err
+	}
+	if len(questions) != 1 || !strings.EqualFold(questions[0].Name.String(), q.name.String()) || questions[0].Type != q.typ {
+		return "", errors.New("dns question mismatch")
+	}
+	var answers []string
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch h.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return "", err
+			}
+			answers = append(answers, net.IP(r.A[:]).String())
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return "", err
+			}
+			answers = append(answers, net.IP(r.AAAA[:]).String())
+		case dnsmessage.TypeCNAME:
+			r, err := p.CNAMEResource()
+			if err != nil {
+				return "", err
+			}
+			answers = append(answers, "CNAME "+r.CNAME.String())
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return "", err
+			}
+		}
+	}
+	rcode := strings.TrimPrefix(header.RCode.String(), "RCode")
+	return fmt.Sprintf("rcode=%s answers=[%s]", rcode, strings.Join(answers, " ")), nil
+}
+
+// seconds between 1900-01-01 and 1970-01-01
+const ntpEpochOffset = 2208988800
+
+func toNTPTime(t time.Time) uint64 {
+	sec := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return sec<<32 | frac
+}
+
+func fromNTPTime(v uint64) time.Time {
+	sec := int64(v>>32) - ntpEpochOffset
+	nsec := int64((v & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(sec, nsec)
+}
+
+// NTPQuery is an NTPv4 client request, https://www.rfc-editor.org/rfc/rfc5905
+type NTPQuery struct {
+	sent     time.Time
+	transmit uint64
+}
+
+func (q *NTPQuery) Request() []byte {
+	b := make([]byte, 48)
+	// LI = 0, VN = 4, Mode = 3 (client)
+	b[0] = 0<<6 | 4<<3 | 3
+	q.sent = time.Now()
+	// a random transmit timestamp is allowed and avoids leaking the local clock,
+	// but the real one lets us compute the offset
+	q.transmit = toNTPTime(q.sent)
+	binary.BigEndian.PutUint64(b[40:], q.transmit)
+	return b
+}
+
+func (q *NTPQuery) Parse(b []byte) (string, error) {
+	received := time.Now()
+	if len(b) < 48 {
+		return "", fmt.Errorf("ntp response too short: %d bytes", len(b))
+	}
+	if mode := b[0] & 0x07; mode != 4 {
+		return "", fmt.Errorf("unexpected ntp mode %d", mode)
+	}
+	if origin := binary.BigEndian.Uint64(b[24:]); origin != q.transmit {
+		return "", errors.New("ntp origin timestamp mismatch")
+	}
+	stratum := b[1]
+	refID := b[12:16]
+	if stratum == 0 {
+		// kiss-o'-death, the reference id is an ascii code like RATE or DENY
+		return "", fmt.Errorf("ntp kiss-o'-death %s", strings.TrimRight(string(refID), "\x00"))
+	}
+	var ref string
+	if stratum == 1 {
+		ref = strings.TrimRight(string(refID), "\x00")
+	} else {
+		ref = net.IP(refID).String()
+	}
+	rx := fromNTPTime(binary.BigEndian.Uint64(b[32:]))
+	tx := fromNTPTime(binary.BigEndian.Uint64(b[40:]))
+	offset := (rx.Sub(q.sent) + tx.Sub(received)) / 2
+	return fmt.Sprintf("stratum=%d ref=%s time=%s offset=%s", stratum, ref, tx.UTC().Format(time.RFC3339Nano), offset), nil
+}
+
+const stunMagicCookie = 0x2112A442
+
+// STUNQuery is a STUN Binding Request, https://www.rfc-editor.org/rfc/rfc5389
+type STUNQuery struct {
+	txID [12]byte
+}
+
+func (q *STUNQuery) Request() []byte {
+	if _, err := rand.Read(q.txID[:]); err != nil {
+		panic(err)
+	}
+	b := make([]byte, 0, 20)
+	b = binary.BigEndian.AppendUint16(b, 0x0001)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint32(b, stunMagicCookie)
+	return append(b, q.txID[:]...)
+}
+
+func (q *STUNQuery) Parse(b []byte) (string, error) {
+	if len(b) < 20 {
+		return "", fmt.Errorf("stun response too short: %d bytes", len(b))
+	}
+	typ := binary.BigEndian.Uint16(b)
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if binary.BigEndian.Uint32(b[4:]) != stunMagicCookie {
+		return "", errors.New("stun magic cookie mismatch")
+	}
+	if [12]byte(b[8:20]) != q.txID {
+		return "", errors.New("stun transaction id mismatch")
+	}
+	if 20+length > len(b) {
+		return "", errors.New("stun message truncated")
+	}
+	switch typ {
+	case 0x0101:
+	case 0x0111:
+		return "", errors.New("stun binding error response")
+	default:
+		return "", fmt.Errorf("unexpected stun message type 0x%04x", typ)
+	}
+	var mapped, xorMapped string
+	attrs := b[20 : 20+length]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs)
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+attrLen > len(attrs) {
+			return "", errors.New("stun attribute truncated")
+		}
+		value := attrs[4 : 4+attrLen]
+		switch attrType {
+		case 0x0001:
+			mapped = parseSTUNAddr(value, nil)
+		case 0x0020:
+			xorMapped = parseSTUNAddr(value, b[4:20])
+		}
+		// attributes are padded to 4 bytes
+		attrs = attrs[min(4+(attrLen+3)&^3, len(attrs)):]
+	}
+	switch {
+	case xorMapped != "":
+		return "mapped=" + xorMapped, nil
+	case mapped != "":
+		return "mapped=" + mapped, nil
+	}
+	return "", errors.New("no mapped address in stun response")
+}
+
+// parseSTUNAddr parses (XOR-)MAPPED-ADDRESS, xor is magic cookie and transaction id for XOR-MAPPED-ADDRESS
+func parseSTUNAddr(v []byte, xor []byte) string {
+	if len(v) < 4 {
+		return ""
+	}
+	port := binary.BigEndian.Uint16(v[2:])
+	var ip net.IP
+	switch v[1] {
+	case 0x01:
+		if len(v) < 8 {
+			return ""
+		}
+		ip = net.IP(append([]byte{}, v[4:8]...))
+	case 0x02:
+		if len(v) < 20 {
+			return ""
+		}
+		ip = net.IP(append([]byte{}, v[4:20]...))
+	default:
+		return ""
+	}
+	if xor != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= xor[i]
+		}
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// sysDescr.0
+var snmpSysDescr = asn1.ObjectIdentifier{1, 3, 6, 1, 2, 1, 1, 1, 0}
+
+type snmpVarBind struct {
+	Name  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type snmpPDU struct {
+	RequestID   int32
+	ErrorStatus int
+	ErrorIndex  int
+	VarBinds    []snmpVarBind
+}
+
+type snmpRequest struct {
+	Version   int
+	Community []byte
+	PDU       snmpPDU `asn1:"tag:0"`
+}
+
+type snmpResponse struct {
+	Version   int
+	Community []byte
+	PDU       snmpPDU `asn1:"tag:2"`
+}
+
+// SNMPQuery is an SNMPv1 GetRequest of sysDescr, https://www.rfc-editor.org/rfc/rfc1157
+type SNMPQuery struct {
+	Community string
+	id        int32
+}
+
+func (q *SNMPQuery) Request() []byte {
+	q.id = int32(randomUint16())
+	b, err := asn1.Marshal(snmpRequest{
+		Community: []byte(q.Community),
+		PDU: snmpPDU{
+			RequestID: q.id,
+			VarBinds:  []snmpVarBind{{Name: snmpSysDescr, Value: asn1.RawValue{Tag: asn1.TagNull}}},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (q *SNMPQuery) Parse(b []byte) (string, error) {
+	var resp snmpResponse
+	if _, err := asn1.Unmarshal(b, &resp); err != nil {
+		return "", fmt.Errorf("invalid snmp response: %w", err)
+	}
+	if resp.PDU.RequestID != q.id {
+		return "", fmt.Errorf("snmp request id mismatch, expected %d, got %d", q.id, resp.PDU.RequestID)
+	}
+	if resp.PDU.ErrorStatus != 0 {
+		return fmt.Sprintf("error-status=%d", resp.PDU.ErrorStatus), nil
+	}
+	for _, v := range resp.PDU.VarBinds {
+		if v.Name.Equal(snmpSysDescr) && v.Value.Tag == asn1.TagOctetString {
+			return "sysDescr=" + printable(v.Value.Bytes), nil
+		}
+	}
+	return "no sysDescr in snmp response", nil
+}
@@ -0,0 +1,185 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveUDP starts a loopback stand-in server answering every datagram with reply, a nil reply is dropped
+func serveUDP(t *testing.T, reply func(req []byte, from *net.UDPAddr) []byte) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if b := reply(buf[:n], from); b != nil {
+				conn.WriteToUDP(b, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// exchange sends a request of q to addr and parses the response
+func exchange(t *testing.T, addr *net.UDPAddr, q UDPQuery) (string, *net.UDPAddr, error) {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(q.Request()); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := q.Parse(buf[:n])
+	return answer, conn.LocalAddr().(*net.UDPAddr), err
+}
+
+// dnsReply answers an A query with 192.0.2.1, the id is increased by idDelta
+func dnsReply(t *testing.T, idDelta uint16) func([]byte, *net.UDPAddr) []byte {
+	return func(req []byte, _ *net.UDPAddr) []byte {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(req); err != nil {
+			t.Errorf("invalid dns request: %v", err)
+			return nil
+		}
+		msg.Header.ID += idDelta
+		msg.Header.Response = true
+		msg.Header.RecursionAvailable = true
+		for _, q := range msg.Questions {
+			if q.Type != dnsmessage.TypeA {
+				continue
+			}
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			})
+		}
+		b, err := msg.Pack()
+		if err != nil {
+			t.Errorf("pack dns response: %v", err)
+			return nil
+		}
+		return b
+	}
+}
+
+// ntpReply answers in mode 4 with stratum 2, the origin timestamp is the transmit timestamp of req xor originXor
+func ntpReply(t *testing.T, originXor uint64) func([]byte, *net.UDPAddr) []byte {
+	return func(req []byte, _ *net.UDPAddr) []byte {
+		if len(req) != 48 || req[0]&0x07 != 3 {
+			t.Errorf("invalid ntp request % x", req)
+			return nil
+		}
+		now := toNTPTime(time.Now())
+		b := make([]byte, 48)
+		b[0] = 4<<3 | 4
+		b[1] = 2
+		copy(b[12:16], net.IPv4(192, 0, 2, 123).To4())
+		binary.BigEndian.PutUint64(b[24:], binary.BigEndian.Uint64(req[40:])^originXor)
+		binary.BigEndian.PutUint64(b[32:], now)
+		binary.BigEndian.PutUint64(b[40:], now)
+		return b
+	}
+}
+
+// stunReply answers a Binding Success with the XOR-MAPPED-ADDRESS of the client, the transaction id is xored with txXor
+func stunReply(t *testing.T, txXor byte) func([]byte, *net.UDPAddr) []byte {
+	return func(req []byte, from *net.UDPAddr) []byte {
+		if len(req) != 20 || binary.BigEndian.Uint16(req) != 0x0001 || binary.BigEndian.Uint32(req[4:]) != stunMagicCookie {
+			t.Errorf("invalid stun request % x", req)
+			return nil
+		}
+		b := binary.BigEndian.AppendUint16(nil, 0x0101)
+		b = binary.BigEndian.AppendUint16(b, 12)
+		b = append(b, req[4:20]...)
+		b[19] ^= txXor
+		b = binary.BigEndian.AppendUint16(b, 0x0020)
+		b = binary.BigEndian.AppendUint16(b, 8)
+		b = append(b, 0, 0x01)
+		b = binary.BigEndian.AppendUint16(b, uint16(from.Port)^uint16(stunMagicCookie>>16))
+		b = binary.BigEndian.AppendUint32(b, binary.BigEndian.Uint32(from.IP.To4())^stunMagicCookie)
+		return b
+	}
+}
+
+func TestUDPQuery(t *testing.T) {
+	dns, err := NewUDPQuery("dns", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		query UDPQuery
+		reply func([]byte, *net.UDPAddr) []byte
+		// want returns the expected answer for the local address of the client
+		want func(local *net.UDPAddr) string
+	}{
+		{"dns", dns, dnsReply(t, 0), func(*net.UDPAddr) string { return "rcode=Success answers=[192.0.2.1]" }},
+		{"ntp", &NTPQuery{}, ntpReply(t, 0), func(*net.UDPAddr) string { return "stratum=2 ref=192.0.2.123 " }},
+		{"stun", &STUNQuery{}, stunReply(t, 0), func(local *net.UDPAddr) string {
+			return "mapped=" + net.JoinHostPort(local.IP.String(), strconv.Itoa(local.Port))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := serveUDP(t, tt.reply)
+			answer, local, err := exchange(t, addr, tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.want(local); !strings.HasPrefix(answer, want) {
+				t.Errorf("answer = %q, want prefix %q", answer, want)
+			}
+		})
+	}
+}
+
+func TestUDPQueryMismatch(t *testing.T) {
+	dns, err := NewDNSQuery("example.com", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		query UDPQuery
+		reply func([]byte, *net.UDPAddr) []byte
+		want  string
+	}{
+		{"dns id", dns, dnsReply(t, 1), "dns id mismatch"},
+		{"ntp origin", &NTPQuery{}, ntpReply(t, 1), "ntp origin timestamp mismatch"},
+		{"stun transaction id", &STUNQuery{}, stunReply(t, 0xff), "stun transaction id mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := serveUDP(t, tt.reply)
+			answer, _, err := exchange(t, addr, tt.query)
+			if err == nil {
+				t.Fatalf("mismatched response accepted: %q", answer)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
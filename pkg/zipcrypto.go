@@ -0,0 +1,292 @@
+package pkg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// WinZipAESMethod is the method of WinZip AES encrypted entries, the real method is in the extra field,
+// https://www.winzip.com/en/support/aes-encryption/
+const WinZipAESMethod = 99
+
+const (
+	winZipAESExtraID = 0x9901
+	// winZipAESStrength 3 is AES-256
+	winZipAESStrength = 3
+	winZipAESMACSize  = 10
+	winZipAESPwvSize  = 2
+	zipCryptoHeadSize = 12
+)
+
+// ErrZipPassword is returned if the password doesn't match the password verifier of an entry
+var ErrZipPassword = errors.New("incorrect password")
+
+// WinZipAESExtra returns the AE-2 extra field of AES-256 for entries compressed with method
+func WinZipAESExtra(method uint16) []byte {
+	b := binary.LittleEndian.AppendUint16(nil, winZipAESExtraID)
+	b = binary.LittleEndian.AppendUint16(b, 7)
+	// vendor version AE-2 doesn't store crc, the mac authenticates the data instead
+	b = binary.LittleEndian.AppendUint16(b, 2)
+	b = append(b, 'A', 'E', winZipAESStrength)
+	return binary.LittleEndian.AppendUint16(b, method)
+}
+
+// ParseWinZipAESExtra finds the AES extra field, version is 1 for AE-1 which keeps the crc, or 2 for AE-2
+func ParseWinZipAESExtra(extra []byte) (method uint16, strength byte, version uint16, ok bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		if id == winZipAESExtraID && size >= 7 {
+			return binary.LittleEndian.Uint16(extra[5:]), extra[4], binary.LittleEndian.Uint16(extra), true
+		}
+		extra = extra[size:]
+	}
+	return 0, 0, 0, false
+}
+
+// winZipAESKeys derives the aes key, the hmac key and the password verifier
+func winZipAESKeys(password string, salt []byte, keySize int) (key, macKey, pwv []byte, err error) {
+	b, err := pbkdf2.Key(sha1.New, password, salt, 1000, 2*keySize+winZipAESPwvSize)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return b[:keySize], b[keySize : 2*keySize], b[2*keySize:], nil
+}
+
+// winZipCTR is AES-CTR with a little endian counter starting from 1, unlike cipher.NewCTR
+type winZipCTR struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	used    int
+}
+
+func newWinZipCTR(key []byte) (*winZipCTR, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &winZipCTR{block: block, used: aes.BlockSize}, nil
+}
+
+func (c *winZipCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.used == aes.BlockSize {
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.stream[:], c.counter[:])
+			c.used = 0
+		}
+		dst[i] = src[i] ^ c.stream[c.used]
+		c.used++
+	}
+}
+
+type winZipAESWriter struct {
+	w   io.Writer
+	ctr *winZipCTR
+	mac hash.Hash
+	buf []byte
+}
+
+// NewWinZipAESWriter encrypts with AES-256, the salt and the password verifier are written first,
+// Close writes the authentication code without closing w
+func NewWinZipAESWriter(w io.Writer, password string) (io.WriteCloser, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, macKey, pwv, err := winZipAESKeys(password, salt, 32)
+	if err != nil {
+		return nil, err
+	}
+	ctr, err := newWinZipCTR(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(salt, pwv...)); err != nil {
+		return nil, err
+	}
+	return &winZipAESWriter{w: w, ctr: ctr, mac: hmac.New(sha1.New, macKey)}, nil
+}
+
+func (a *winZipAESWriter) Write(p []byte) (int, error) {
+	if cap(a.buf) < len(p) {
+		a.buf = make([]byte, len(p))
+	}
+	buf := a.buf[:len(p)]
+	a.ctr.XORKeyStream(buf, p)
+	a.mac.Write(buf)
+	return a.w.Write(buf)
+}
+
+func (a *winZipAESWriter) Close() error {
+	_, err := a.w.Write(a.mac.Sum(nil)[:winZipAESMACSize])
+	return err
+}
+
+type winZipAESReader struct {
+	r   io.Reader
+	ctr *winZipCTR
+	mac hash.Hash
+	// tail is the authentication code after the data
+	tail io.Reader
+}
+
+// NewWinZipAESReader decrypts the raw data of size bytes of an entry with strength from the extra field,
+// the authentication code is checked at EOF
+func NewWinZipAESReader(r io.Reader, size int64, strength byte, password string) (io.Reader, error) {
+	if strength < 1 || strength > 3 {
+		return nil, fmt.Errorf("unsupported aes strength %d", strength)
+	}
+	keySize := 8 * (int(strength) + 1)
+	saltSize := keySize / 2
+	size -= int64(saltSize + winZipAESPwvSize + winZipAESMACSize)
+	if size < 0 {
+		return nil, errors.New("aes encrypted data too short")
+	}
+	head := make([]byte, saltSize+winZipAESPwvSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	key, macKey, pwv, err := winZipAESKeys(password, head[:saltSize], keySize)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(pwv, head[saltSize:]) != 1 {
+		return nil, ErrZipPassword
+	}
+	ctr, err := newWinZipCTR(key)
+	if err != nil {
+		return nil, err
+	}
+	return &winZipAESReader{r: io.LimitReader(r, size), ctr: ctr, mac: hmac.New(sha1.New, macKey), tail: r}, nil
+}
+
+func (a *winZipAESReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	a.mac.Write(p[:n])
+	a.ctr.XORKeyStream(p[:n], p[:n])
+	if err == io.EOF {
+		code := make([]byte, winZipAESMACSize)
+		if _, err := io.ReadFull(a.tail, code); err != nil {
+			return n, err
+		}
+		if !hmac.Equal(code, a.mac.Sum(nil)[:winZipAESMACSize]) {
+			return n, errors.New("aes authentication code mismatch")
+		}
+	}
+	return n, err
+}
+
+// zipCryptoKeys is the traditional PKWARE encryption, which is weak and only for compatibility
+type zipCryptoKeys [3]uint32
+
+func newZipCryptoKeys(password string) *zipCryptoKeys {
+	k := &zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+	for i := 0; i < len(password); i++ {
+		k.update(password[i])
+	}
+	return k
+}
+
+func (k *zipCryptoKeys) update(b byte) {
+	k[0] = crc32.IEEETable[byte(k[0])^b] ^ k[0]>>8
+	k[1] = (k[1]+k[0]&0xff)*134775813 + 1
+	k[2] = crc32.IEEETable[byte(k[2])^byte(k[1]>>24)] ^ k[2]>>8
+}
+
+func (k *zipCryptoKeys) stream() byte {
+	t := k[2] | 2
+	return byte(t * (t ^ 1) >> 8)
+}
+
+func (k *zipCryptoKeys) encrypt(dst, src []byte) {
+	for i, b := range src {
+		dst[i] = b ^ k.stream()
+		k.update(b)
+	}
+}
+
+func (k *zipCryptoKeys) decrypt(dst, src []byte) {
+	for i, b := range src {
+		dst[i] = b ^ k.stream()
+		k.update(dst[i])
+	}
+}
+
+type zipCryptoWriter struct {
+	w    io.Writer
+	keys *zipCryptoKeys
+	buf  []byte
+}
+
+// NewZipCryptoWriter encrypts with ZipCrypto, check is the high byte of the crc,
+// or of the msdos time if the entry has a data descriptor
+func NewZipCryptoWriter(w io.Writer, password string, check byte) (io.Writer, error) {
+	keys := newZipCryptoKeys(password)
+	head := make([]byte, zipCryptoHeadSize)
+	if _, err := rand.Read(head[:zipCryptoHeadSize-1]); err != nil {
+		return nil, err
+	}
+	head[zipCryptoHeadSize-1] = check
+	keys.encrypt(head, head)
+	if _, err := w.Write(head); err != nil {
+		return nil, err
+	}
+	return &zipCryptoWriter{w: w, keys: keys}, nil
+}
+
+func (z *zipCryptoWriter) Write(p []byte) (int, error) {
+	if cap(z.buf) < len(p) {
+		z.buf = make([]byte, len(p))
+	}
+	buf := z.buf[:len(p)]
+	z.keys.encrypt(buf, p)
+	return z.w.Write(buf)
+}
+
+type zipCryptoReader struct {
+	r    io.Reader
+	keys *zipCryptoKeys
+}
+
+// NewZipCryptoReader decrypts ZipCrypto, check is the same as NewZipCryptoWriter,
+// a wrong password passes the check by chance of 1/256 and then fails the crc
+func NewZipCryptoReader(r io.Reader, password string, check byte) (io.Reader, error) {
+	keys := newZipCryptoKeys(password)
+	head := make([]byte, zipCryptoHeadSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	keys.decrypt(head, head)
+	if head[zipCryptoHeadSize-1] != check {
+		return nil, ErrZipPassword
+	}
+	return &zipCryptoReader{r: r, keys: keys}, nil
+}
+
+func (z *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	z.keys.decrypt(p[:n], p[:n])
+	return n, err
+}
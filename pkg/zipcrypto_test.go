@@ -0,0 +1,135 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const zipTestPassword = "correct horse"
+
+// zipTestData is longer than an aes block and not a multiple of it
+var zipTestData = []byte(strings.Repeat("awake zip encryption ", 50))
+
+func sealWinZipAES(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWinZipAESWriter(&buf, zipTestPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sealZipCrypto(t *testing.T, data []byte, check byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewZipCryptoWriter(&buf, zipTestPassword, check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// openers return a reader of the plain data of raw, which is sealed with zipTestPassword
+var zipTestOpeners = []struct {
+	name string
+	seal func(t *testing.T, data []byte) []byte
+	open func(raw []byte, password string) (io.Reader, error)
+}{
+	{
+		"aes",
+		sealWinZipAES,
+		func(raw []byte, password string) (io.Reader, error) {
+			return NewWinZipAESReader(bytes.NewReader(raw), int64(len(raw)), winZipAESStrength, password)
+		},
+	},
+	{
+		"zipcrypto",
+		func(t *testing.T, data []byte) []byte { return sealZipCrypto(t, data, 0x5a) },
+		func(raw []byte, password string) (io.Reader, error) {
+			return NewZipCryptoReader(bytes.NewReader(raw), password, 0x5a)
+		},
+	},
+}
+
+func TestZipEncryptionRoundTrip(t *testing.T) {
+	for _, tt := range zipTestOpeners {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, data := range [][]byte{nil, []byte("x"), zipTestData} {
+				raw := tt.seal(t, data)
+				r, err := tt.open(raw, zipTestPassword)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Errorf("round trip of %d bytes = %q", len(data), got)
+				}
+			}
+		})
+	}
+}
+
+func TestZipEncryptionWrongPassword(t *testing.T) {
+	for _, tt := range zipTestOpeners {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := tt.seal(t, zipTestData)
+			// the check byte or the password verifier of a wrong password matches by chance now and then,
+			// one of several wrong passwords must be rejected
+			for i := 0; i < 8; i++ {
+				_, err := tt.open(raw, "wrong"+strconv.Itoa(i))
+				if errors.Is(err, ErrZipPassword) {
+					return
+				}
+				if err != nil {
+					t.Fatalf("err = %v, want %v", err, ErrZipPassword)
+				}
+			}
+			t.Errorf("wrong passwords accepted")
+		})
+	}
+}
+
+func TestWinZipAESTampered(t *testing.T) {
+	raw := sealWinZipAES(t, zipTestData)
+	// flip a bit of the data after the salt and the password verifier
+	raw[len(raw)/2] ^= 0x01
+	r, err := NewWinZipAESReader(bytes.NewReader(raw), int64(len(raw)), winZipAESStrength, zipTestPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil || !strings.Contains(err.Error(), "authentication code mismatch") {
+		t.Errorf("tampered data err = %v, want authentication code mismatch", err)
+	}
+}
+
+func TestParseWinZipAESExtra(t *testing.T) {
+	// another extra field before the aes one must be skipped
+	other := []byte{0x55, 0x54, 0x05, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}
+	extra := append(other, WinZipAESExtra(8)...)
+	method, strength, version, ok := ParseWinZipAESExtra(extra)
+	if !ok || method != 8 || strength != winZipAESStrength || version != 2 {
+		t.Errorf("ParseWinZipAESExtra = %d, %d, %d, %v, want 8, %d, 2, true", method, strength, version, ok, winZipAESStrength)
+	}
+	for n := 0; n < len(extra); n++ {
+		if _, _, _, ok := ParseWinZipAESExtra(extra[:n]); ok {
+			t.Errorf("extra truncated to %d bytes parsed", n)
+		}
+	}
+}